@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupRemote string
+	backupAll    bool
+	backupJSON   bool
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup [path]",
+	Short: "Pushes the Dura refs to the backup remote",
+	Long: `Pushes the Dura refs and Dura tags of the repository containing path (the current directory by default), or of every watched
+repository with --all, to its backup remote: --remote, or backup.remote (or the backup_remote of the watched directory). The remote
+may be the name of a remote of the repository or the URL of a repository, including a file:// URL of a local bare repository.
+
+Refs are pushed with a lease, like git push --force-with-lease: a remote ref is only overwritten or deleted while it still points to
+the snapshot Dura last pushed to it, so pruned and collected refs carry over to the backup while refs changed by anyone else are
+reported and left alone. The values last pushed are recorded under refs/dura-backup/. Failed pushes are retried backup.retries
+times, waiting backup.retry_seconds seconds before the first retry and twice as long before each of the next ones.
+
+The daemon pushes a repository after each capture creating a snapshot (unless backup.on_capture is false), and every watched
+repository every backup.interval_minutes minutes when set.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			path    = CWD
+			opts    = dura.BackupOptions{Remote: backupRemote}
+			results []dura.BackupResult
+			failed  bool
+		)
+		if len(args) > 0 {
+			path = args[0]
+		}
+		if backupAll {
+			if len(args) > 0 {
+				cobra.CheckErr(errors.New("a path can't be given along with --all"))
+			}
+			results = dura.BackupAll(opts)
+		} else {
+			var result *dura.BackupResult
+			if result, err = dura.Backup(path, opts); result == nil {
+				result = &dura.BackupResult{Repo: path}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, *result)
+		}
+		for _, result := range results {
+			failed = failed || result.Error != ""
+		}
+		if backupJSON {
+			var bytes []byte
+			bytes, err = json.MarshalIndent(results, "", "  ")
+			cobra.CheckErr(err)
+			fmt.Println(string(bytes))
+		} else {
+			printBackup(results)
+		}
+		if failed {
+			cobra.CheckErr(errors.New("some repositories could not be backed up"))
+		}
+	},
+}
+
+func printBackup(results []dura.BackupResult) {
+	for _, result := range results {
+		switch {
+		case result.Disabled:
+			fmt.Printf("%s: no backup remote set, nothing to back up\n", result.Repo)
+		case result.Remote == "":
+			fmt.Printf("%s: %s\n", result.Repo, result.Error)
+		default:
+			fmt.Printf("%s: pushed %d refs and deleted %d refs on %s\n", result.Repo, len(result.Pushed), len(result.Deleted), result.Remote)
+			for _, ref := range result.Rejected {
+				fmt.Printf("  rejected %s, it changed on the remote\n", ref)
+			}
+			if result.Error != "" {
+				fmt.Printf("  error: %s\n", result.Error)
+			}
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+
+	backupCmd.Flags().StringVarP(&backupRemote, "remote", "r", "", "The remote name or repository URL to push to. (default: backup.remote)")
+	backupCmd.Flags().BoolVarP(&backupAll, "all", "a", false, "Back up every watched repository with a backup remote. (default: false)")
+	backupCmd.Flags().BoolVar(&backupJSON, "json", false, "Print the results as JSON. (default: false)")
+}
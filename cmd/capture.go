@@ -26,18 +26,19 @@ import (
 var captureCmd = &cobra.Command{
 	Use:   "capture",
 	Short: "Run a single backup of an entire repository.",
-	Long:  `Run a single backup of an entire repository. This is the one single iteration of the 'serve'' control loop.`,
+	Long: `Run a single backup of an entire repository. This is the one single iteration of the 'serve'' control loop.
+If a Dura daemon is running the capture is carried out by the daemon (through its control socket), otherwise it runs directly.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var cs *dura.CaptureStatus
 		if len(args) == 0 { // Use CWD
 			fmt.Println(CWD)
-			cs, err = dura.Capture(CWD)
+			cs, err = dura.CaptureVia(CWD)
 			cobra.CheckErr(err)
 			fmt.Println(cs.CommitHash)
 		} else { // Use paths provided
 			var path string
 			for _, path = range args {
-				cs, err = dura.Capture(path)
+				cs, err = dura.CaptureVia(path)
 				cobra.CheckErr(err)
 				fmt.Println(cs.CommitHash)
 			}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+	git "github.com/libgit2/git2go/v33"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffPath       string
+	diffStat       bool
+	diffNameStatus bool
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff [from] [to]",
+	Short: "Shows the differences between snapshots, HEAD and the working tree",
+	Long: `Shows the differences between two states of a repository. Each side may be a snapshot, HEAD or worktree (the working
+tree, as Dura would capture it). Without arguments the newest snapshot is compared to the working tree, with a single argument
+that side is compared to the working tree.
+
+The differences are printed as a unified patch, or with --stat as a diffstat or with --name-status as the status and path of
+every changed file.
+` + selectorHelp,
+	Args: cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			repo     *git.Repository
+			from, to string
+			format   = dura.DiffFormatPatch
+			out      []byte
+		)
+		if diffStat && diffNameStatus {
+			cobra.CheckErr(errors.New("--stat and --name-status can't be combined"))
+		}
+		if diffStat {
+			format = dura.DiffFormatStat
+		} else if diffNameStatus {
+			format = dura.DiffFormatNameStatus
+		}
+		if len(args) > 0 {
+			from = args[0]
+		}
+		if len(args) > 1 {
+			to = args[1]
+		}
+		repo, err = dura.OpenRepository(diffPath)
+		cobra.CheckErr(err)
+		out, err = dura.DiffSnapshots(repo, from, to, format)
+		cobra.CheckErr(err)
+		if _, err = os.Stdout.Write(out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringVarP(&diffPath, "path", "p", ".", "The repository (or any directory within it) to diff.")
+	diffCmd.Flags().BoolVar(&diffStat, "stat", false, "Print a diffstat instead of a patch. (default: false)")
+	diffCmd.Flags().BoolVar(&diffNameStatus, "name-status", false, "Print the status and path of every changed file instead of a patch. (default: false)")
+}
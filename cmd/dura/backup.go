@@ -0,0 +1,446 @@
+package dura
+
+import (
+	"encoding/json"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BackupRefNamespace records, per backup remote, the value each Dura ref had when it
+	// was last pushed, which is the lease the next push is checked against
+	BackupRefNamespace = "refs/dura-backup"
+)
+
+var (
+	backupKeyRe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+	// backupQueue holds the repositories waiting to be backed up by the daemon, a
+	// repository is queued once however many captures request its backup meanwhile
+	backupQueue   = make(chan string, 64)
+	backupPending = map[string]bool{}
+	backupMu      sync.Mutex
+	// lastBackup is when the daemon last queued every watched repository for backup
+	lastBackup time.Time
+)
+
+// BackupOptions configures Backup, zero values fall back to the backup configuration.
+type BackupOptions struct {
+	// Remote is the name of a remote of the repository or the URL of a repository
+	Remote string
+}
+
+// BackupResult is the outcome of pushing the Dura refs of a repository to its backup
+// remote.
+type BackupResult struct {
+	Repo   string `json:"repo"`
+	Remote string `json:"remote,omitempty"`
+	// Disabled is true when no backup remote is set for the repository, nothing is pushed
+	Disabled bool `json:"disabled,omitempty"`
+	// Pushed are the refs created or moved on the remote, Deleted those removed from it
+	// because they no longer exist locally
+	Pushed  []string `json:"pushed,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+	// Rejected are the refs left alone because the remote changed them since they were
+	// last pushed
+	Rejected []string `json:"rejected,omitempty"`
+	Attempts int      `json:"attempts"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// BackupLeaseError is returned when refs of the backup remote were changed by someone
+// else since Dura last pushed them, they are never overwritten.
+type BackupLeaseError struct {
+	Refs []string
+}
+
+func (e *BackupLeaseError) Error() string {
+	return fmt.Sprintf("refusing to overwrite remote refs changed since they were last pushed: %s", strings.Join(e.Refs, ", "))
+}
+
+// backupRemoteFor returns the backup remote of repositories watched with wc, an empty
+// string if they aren't backed up.
+func backupRemoteFor(wc WatchConfig) string {
+	if wc.BackupRemote != nil {
+		return *wc.BackupRemote
+	}
+	return currentConfig().Backup.Remote
+}
+
+// backupTracking returns the namespace recording the refs last pushed to remote.
+func backupTracking(remote string) string {
+	return fmt.Sprintf("%s/%s", BackupRefNamespace, strings.Trim(backupKeyRe.ReplaceAllString(remote, "-"), "-"))
+}
+
+// Backup pushes the Dura refs and Dura tags of the repository at path to its backup
+// remote (opts.Remote, or the backup remote configured for it). Refs are pushed with a
+// lease, in the manner of git push --force-with-lease: a remote ref is only overwritten
+// or deleted while it still has the value Dura last pushed, so rewriting snapshots
+// (dura prune) or collecting refs (dura gc) carries over to the backup while refs changed
+// by anyone else are rejected. Failed pushes are retried backup.retries times, waiting
+// twice as long before each retry.
+func Backup(path string, opts BackupOptions) (result *BackupResult, err error) {
+	log.Trace().Msg("entered Backup")
+	logger := log.With().Str("path", path).Logger()
+	var (
+		repo   *git.Repository
+		store  *git.Repository
+		remote *git.Remote
+	)
+	if repo, err = OpenRepository(path); err != nil {
+		return
+	}
+	if store, err = duraStore(repo); err != nil {
+		return
+	}
+	result = &BackupResult{Repo: path, Remote: opts.Remote}
+	if result.Remote == "" {
+		result.Remote = backupRemoteFor(currentConfig().WatchConfigFor(repo.Workdir()))
+	}
+	if result.Remote == "" {
+		logger.Debug().Msg("no backup remote set, nothing to back up")
+		result.Disabled = true
+		return
+	}
+	logger = logger.With().Str("remote", result.Remote).Logger()
+	// The refs are pushed from the repository holding them, a shadow repository pushes
+	// to the URL of the remote of the repository
+	url := result.Remote
+	if named, lookupErr := repo.Remotes.Lookup(result.Remote); lookupErr == nil {
+		if url = named.PushUrl(); url == "" {
+			url = named.Url()
+		}
+		named.Free()
+	}
+	if remote, err = store.Remotes.CreateAnonymous(url); err != nil {
+		logger.Error().Err(err).Msg("error encountered while opening backup remote")
+		return
+	}
+	defer remote.Free()
+
+	settings := currentConfig()
+	delay := time.Duration(settings.Backup.RetrySeconds) * time.Second
+	if delay <= 0 {
+		delay = time.Duration(DefBackupRetrySeconds) * time.Second
+	}
+	for {
+		result.Attempts++
+		result.Pushed, result.Deleted, result.Rejected = nil, nil, nil
+		if err = pushBackup(store, remote, result); err == nil {
+			break
+		}
+		if _, lease := err.(*BackupLeaseError); lease || result.Attempts > settings.Backup.Retries {
+			logger.Error().Err(err).Int("attempts", result.Attempts).Msg("error encountered while pushing Dura refs")
+			return
+		}
+		logger.Warn().Err(err).Int("attempt", result.Attempts).Dur("retryIn", delay).Msg("push to backup remote failed, retrying")
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	logger.Info().Int("pushed", len(result.Pushed)).Int("deleted", len(result.Deleted)).Msg("backed up Dura refs")
+	log.Trace().Msg("leaving Backup")
+	return
+}
+
+// BackupAll runs Backup on every repository watched which has a backup remote, a
+// repository which fails is reported in its result and doesn't stop the others.
+func BackupAll(opts BackupOptions) (results []BackupResult) {
+	log.Trace().Msg("entered BackupAll")
+	for root, wc := range currentConfig().GitRepos() {
+		if opts.Remote == "" && backupRemoteFor(wc) == "" {
+			continue
+		}
+		repos, err := discoverRepos(root, wc)
+		if err != nil {
+			log.Error().Err(err).Msgf("error encountered while discovering repositories in '%s', will continue", root)
+			results = append(results, BackupResult{Repo: root, Error: err.Error()})
+			continue
+		}
+		for _, repo := range repos {
+			result, err := Backup(repo, opts)
+			if result == nil {
+				result = &BackupResult{Repo: repo}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, *result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Repo < results[j].Repo })
+	log.Trace().Msg("leaving BackupAll")
+	return
+}
+
+// pushBackup makes a single attempt at bringing the refs of remote in line with the
+// local Dura refs and tags, recording the outcome in result.
+func pushBackup(repo *git.Repository, remote *git.Remote, result *BackupResult) (err error) {
+	log.Trace().Msg("entered pushBackup")
+	var (
+		refs     []string
+		heads    []git.RemoteHead
+		refspecs []string
+		tracking = backupTracking(result.Remote)
+		local    = map[string]string{}
+		leased   = map[string]string{}
+		current  = map[string]string{}
+		failed   = map[string]string{}
+	)
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	if err = eachRef(repo, TagRefNamespace+"/*", func(ref *git.Reference) {
+		refs = append(refs, ref.Name())
+	}); err != nil {
+		return
+	}
+	for _, name := range refs {
+		if ref, lookupErr := repo.References.Lookup(name); lookupErr == nil && ref.Target() != nil {
+			local[name] = ref.Target().String()
+		}
+	}
+	if err = eachRef(repo, tracking+"/*", func(ref *git.Reference) {
+		if ref.Target() != nil {
+			leased["refs/"+strings.TrimPrefix(ref.Name(), tracking+"/")] = ref.Target().String()
+		}
+	}); err != nil {
+		return
+	}
+
+	callbacks := git.RemoteCallbacks{
+		CredentialsCallback: backupCredentials,
+		PushUpdateReferenceCallback: func(refname string, status string) error {
+			if status != "" {
+				failed[refname] = status
+			}
+			return nil
+		},
+	}
+	if err = remote.ConnectPush(&callbacks, nil, nil); err != nil {
+		return
+	}
+	if heads, err = remote.Ls(); err != nil {
+		remote.Disconnect()
+		return
+	}
+	for _, head := range heads {
+		current[head.Name] = head.Id.String()
+	}
+
+	var pushed, deleted []string
+	for name, hash := range local {
+		switch remoteHash, ok := current[name]; {
+		case ok && remoteHash == hash:
+			// Already backed up, possibly by an attempt which failed to record it
+		case !ok || remoteHash == leased[name]:
+			refspecs = append(refspecs, fmt.Sprintf("+%s:%s", name, name))
+			pushed = append(pushed, name)
+		default:
+			result.Rejected = append(result.Rejected, name)
+		}
+	}
+	for name, hash := range leased {
+		if _, ok := local[name]; ok {
+			continue
+		}
+		if remoteHash, ok := current[name]; ok {
+			if remoteHash != hash {
+				result.Rejected = append(result.Rejected, name)
+				continue
+			}
+			refspecs = append(refspecs, ":"+name)
+			deleted = append(deleted, name)
+		}
+	}
+	if len(refspecs) > 0 {
+		log.Debug().Strs("refspecs", refspecs).Msg("pushing to backup remote")
+		err = remote.Push(refspecs, &git.PushOptions{RemoteCallbacks: callbacks})
+	}
+	remote.Disconnect()
+	if err != nil {
+		return
+	}
+	for name, status := range failed {
+		log.Warn().Str("ref", name).Str("status", status).Msg("backup remote refused ref")
+		result.Rejected = append(result.Rejected, name)
+	}
+	for _, name := range pushed {
+		if _, refused := failed[name]; !refused {
+			result.Pushed = append(result.Pushed, name)
+		}
+	}
+	for _, name := range deleted {
+		if _, refused := failed[name]; !refused {
+			result.Deleted = append(result.Deleted, name)
+		}
+	}
+	if err = recordBackup(repo, tracking, local, leased, failed); err != nil {
+		return
+	}
+	sort.Strings(result.Pushed)
+	sort.Strings(result.Deleted)
+	sort.Strings(result.Rejected)
+	if len(result.Rejected) > 0 {
+		err = &BackupLeaseError{Refs: result.Rejected}
+	}
+	log.Trace().Msg("leaving pushBackup")
+	return
+}
+
+// recordBackup moves the lease of every ref backed up to its local value and drops the
+// lease of refs no longer existing locally, refs the remote refused keep their lease.
+func recordBackup(repo *git.Repository, tracking string, local map[string]string, leased map[string]string, failed map[string]string) (err error) {
+	for name, hash := range local {
+		if _, refused := failed[name]; refused || leased[name] == hash {
+			continue
+		}
+		var oid *git.Oid
+		if oid, err = git.NewOid(hash); err != nil {
+			return
+		}
+		lease := tracking + "/" + strings.TrimPrefix(name, "refs/")
+		if _, err = repo.References.Create(lease, oid, true, "dura backup: pushed "+name); err != nil {
+			log.Error().Err(err).Str("ref", lease).Msg("error encountered while recording backup lease")
+			return
+		}
+	}
+	for name := range leased {
+		if _, ok := local[name]; ok {
+			continue
+		}
+		if _, refused := failed[name]; refused {
+			continue
+		}
+		lease := tracking + "/" + strings.TrimPrefix(name, "refs/")
+		if ref, lookupErr := repo.References.Lookup(lease); lookupErr == nil {
+			if err = ref.Delete(); err != nil {
+				log.Error().Err(err).Str("ref", lease).Msg("error encountered while removing backup lease")
+				return
+			}
+		}
+	}
+	return
+}
+
+// backupCredentials authenticates pushes with the SSH agent, or the default
+// credentials of the platform for HTTP remotes.
+func backupCredentials(url string, username string, allowed git.CredentialType) (*git.Credential, error) {
+	if username == "" {
+		username = "git"
+	}
+	switch {
+	case allowed&git.CredentialTypeSSHKey != 0:
+		return git.NewCredentialSSHKeyFromAgent(username)
+	case allowed&git.CredentialTypeDefault != 0:
+		return git.NewCredentialDefault()
+	}
+	return nil, fmt.Errorf("no credentials available for %s", url)
+}
+
+// backupAfterCapture backs up repo once a capture created a snapshot, when
+// backup.on_capture is set. The daemon queues the backup so captures aren't held up by
+// the push, other callers push straight away.
+func backupAfterCapture(repo string, queue bool) {
+	if settings := currentConfig(); !settings.Backup.OnCapture || backupRemoteFor(settings.WatchConfigFor(repo)) == "" {
+		return
+	}
+	if queue {
+		requestBackup(repo)
+	} else {
+		runBackup(repo)
+	}
+}
+
+// requestBackup queues repo for backup by the daemon's backup worker.
+func requestBackup(repo string) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	if backupPending[repo] {
+		return
+	}
+	select {
+	case backupQueue <- repo:
+		backupPending[repo] = true
+	default:
+		log.Warn().Str("repo", repo).Msg("backup queue full, skipping backup")
+	}
+}
+
+// maybeBackup queues every watched repository for backup if backup.interval_minutes
+// have passed since the daemon last did, it is called from the daemon's capture loop.
+func maybeBackup() {
+	interval := time.Duration(currentConfig().Backup.IntervalMinutes) * time.Minute
+	if interval <= 0 || isPaused() || time.Since(lastBackup) < interval {
+		return
+	}
+	log.Debug().Dur("interval", interval).Msg("queueing scheduled backups")
+	lastBackup = time.Now()
+	for root, wc := range currentConfig().GitRepos() {
+		if backupRemoteFor(wc) == "" {
+			continue
+		}
+		repos, err := discoverRepos(root, wc)
+		if err != nil {
+			log.Error().Err(err).Msgf("error encountered while discovering repositories in '%s', will continue", root)
+			continue
+		}
+		for _, repo := range repos {
+			requestBackup(repo)
+		}
+	}
+}
+
+// runBackups backs up the queued repositories one at a time until a shutdown is
+// requested.
+func runBackups() {
+	log.Trace().Msg("entered runBackups")
+	for {
+		select {
+		case <-shutdown:
+			log.Trace().Msg("leaving runBackups")
+			return
+		case repo := <-backupQueue:
+			backupMu.Lock()
+			delete(backupPending, repo)
+			backupMu.Unlock()
+			runBackup(repo)
+		}
+	}
+}
+
+// runBackup backs up repo and writes the outcome to the operation log.
+func runBackup(repo string) {
+	start := time.Now()
+	result, err := Backup(repo, BackupOptions{})
+	operation := Operation{Backup: &OperationBackup{
+		Repo:    repo,
+		Op:      result,
+		Latency: float32(time.Since(start)),
+	}}
+	if err != nil {
+		errStr := err.Error()
+		operation.Backup.Error = &errStr
+	}
+	if !operation.ShouldLog() {
+		return
+	}
+	bytes, marshalErr := json.Marshal(operation)
+	if marshalErr != nil {
+		log.Error().Err(marshalErr).Msg("Error occurred while JSON marshalling operation")
+		return
+	}
+	if err != nil {
+		log.Error().RawJSON("result", bytes).Msg("")
+	} else {
+		log.Info().RawJSON("result", bytes).Msg("")
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
+	git "github.com/libgit2/git2go/v33"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 var (
@@ -18,18 +21,49 @@ var (
 	configType             = "toml"
 	configName             = ".go-dura"
 	DefSleepSeconds        = 5
+	DefMaxDepth            = 255
+	DefMode                = ModePoll
+	DefDebounceMillis      = 1000
+	DefLogLevel            = "info"
+	DefLogMaxSizeMB        = 100
+	DefLogMaxAgeDays       = 28
+	DefLogMaxBackups       = 5
+	DefLogCompress         = true
+	DefBranchPrefix        = "dura"
+	DefGCBranches          = []string{"main", "master"}
+	DefPruneExpireDays     = 14
+	DefBackupRetries       = 3
+	DefBackupRetrySeconds  = 2
 	fileMode        uint32 = 0644
+	// configLock guards config, which the daemon reloads (see ReloadConfig) while its
+	// goroutines read it through currentConfig
+	configLock sync.RWMutex
 )
 
-func GetConfig() (config *Config) {
+func GetConfig() *Config {
 	log.Trace().Msg("returning config")
-	return config
+	return &config
+}
+
+// currentConfig returns a copy of the configuration, with its own repositories map, which
+// a concurrent reload leaves untouched. Code running in the daemon reads the
+// configuration through it.
+func currentConfig() (c *Config) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	snapshot := config
+	snapshot.Repositories = make(map[string]WatchConfig, len(config.Repositories))
+	for path, wc := range config.Repositories {
+		snapshot.Repositories[path] = wc
+	}
+	return &snapshot
 }
 
 func InitConfig() {
 	config = Config{
 		Commit: CommitConfig{
 			ExcludeGitConfig: false,
+			AuthorTime:       AuthorTimeCapture,
 		},
 		Repositories: map[string]WatchConfig{},
 	}
@@ -62,10 +96,48 @@ func InitConfig() {
 		"author":             nil,
 		"email":              nil,
 		"exclude_git_config": false,
+		"author_time":        AuthorTimeCapture,
+		"message_template":   "",
+		"ref_namespace":      DefRefNamespace,
+		"ref_pattern":        DefRefPattern,
+		"lineage":            false,
+		"shadow":             false,
 	})
 	log.Debug().Msg("viper default commit structure set")
+	viper.SetDefault("retention", map[string]interface{}{
+		"keep_all_hours":       0,
+		"keep_hourly":          0,
+		"keep_daily":           0,
+		"keep_weekly":          0,
+		"prune_interval_hours": 0,
+	})
+	log.Debug().Msg("viper default retention structure set")
+	viper.SetDefault("gc", map[string]interface{}{
+		"branches":          DefGCBranches,
+		"archive":           false,
+		"prune_expire_days": DefPruneExpireDays,
+	})
+	log.Debug().Msg("viper default gc structure set")
+	viper.SetDefault("backup", map[string]interface{}{
+		"remote":           "",
+		"on_capture":       true,
+		"interval_minutes": 0,
+		"retries":          DefBackupRetries,
+		"retry_seconds":    DefBackupRetrySeconds,
+	})
+	log.Debug().Msg("viper default backup structure set")
 	viper.SetDefault("dura.sleep_seconds", DefSleepSeconds)
 	log.Debug().Msgf("Dura sleep seconds set to %d seconds", DefSleepSeconds)
+	viper.SetDefault("dura.mode", DefMode)
+	log.Debug().Msgf("Dura mode set to %s", DefMode)
+	viper.SetDefault("dura.debounce_millis", DefDebounceMillis)
+	log.Debug().Msgf("Dura debounce set to %d milliseconds", DefDebounceMillis)
+	viper.SetDefault("dura.log_level", DefLogLevel)
+	viper.SetDefault("dura.log_max_size_mb", DefLogMaxSizeMB)
+	viper.SetDefault("dura.log_max_age_days", DefLogMaxAgeDays)
+	viper.SetDefault("dura.log_max_backups", DefLogMaxBackups)
+	viper.SetDefault("dura.log_compress", DefLogCompress)
+	log.Debug().Msg("Dura log file rotation defaults set")
 
 	viper.AutomaticEnv() // read in environment variables that match
 	log.Debug().Msg("viper automatic environment setup called")
@@ -73,8 +145,11 @@ func InitConfig() {
 	log.Trace().Msg("setting callback for OnConfigChange")
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		log.Debug().Msg("configuration change detected in config file")
-		log.Trace().Msg("calling readInConfig()")
-		readInConfig()
+		// A bad edit of the file is reported and the current configuration kept
+		log.Trace().Msg("calling ReloadConfig()")
+		if ReloadConfig() == nil {
+			requestRescan()
+		}
 	})
 	viper.WatchConfig()
 	log.Debug().Msg("viper set to watch configuration file for changes")
@@ -87,22 +162,63 @@ func InitConfig() {
 
 func readInConfig() (err error) {
 	log.Trace().Msg("entered readInConfig")
+	configLock.Lock()
+	defer configLock.Unlock()
 	if err = viper.ReadInConfig(); err == nil {
 		log.Info().Msgf("Loaded configuration: %s", viper.ConfigFileUsed())
 	} else {
 		log.Fatal().Err(err).Msg("error encountered while attempting to read in configuration")
 	}
-	if err = viper.Unmarshal(&config); err != nil {
+	// The configuration is decoded afresh rather than over the current one, whose slices
+	// and pointers may be in use by the daemon's goroutines
+	loaded := Config{Repositories: map[string]WatchConfig{}}
+	if err = viper.Unmarshal(&loaded); err != nil {
 		log.Fatal().Err(err).Msg("error encountered while unmarshalling viper in config structure")
 	}
+	config = loaded
 	log.Trace().Msg("leaving readInConfig")
 	return
 }
 
+// ReloadConfig re-reads the configuration file. Unlike the initial load, an unreadable
+// or invalid configuration is reported to the caller and the current one kept.
+func ReloadConfig() (err error) {
+	log.Trace().Msg("entered ReloadConfig")
+	configLock.Lock()
+	defer configLock.Unlock()
+	reloaded := Config{Repositories: map[string]WatchConfig{}}
+	if err = viper.ReadInConfig(); err != nil {
+		log.Error().Err(err).Msg("error encountered while attempting to re-read configuration")
+		return
+	}
+	if err = viper.Unmarshal(&reloaded); err != nil {
+		log.Error().Err(err).Msg("error encountered while unmarshalling viper in config structure")
+		return
+	}
+	config = reloaded
+	log.Info().Msgf("Reloaded configuration: %s", viper.ConfigFileUsed())
+	log.Trace().Msg("leaving ReloadConfig")
+	return
+}
+
 type WatchConfig struct {
 	Include  []string `toml:"include" mapstructure:"include,omitempty"`
 	Exclude  []string `toml:"exclude" mapstructure:"exclude,omitempty"`
 	MaxDepth int      `toml:"max_depth" mapstructure:"max_depth,omitempty"`
+	// Author, Email and MessageTemplate override the commit settings of the same name for
+	// the repositories of this watch
+	Author          *string `toml:"author,omitempty" mapstructure:"author,omitempty"`
+	Email           *string `toml:"email,omitempty" mapstructure:"email,omitempty"`
+	MessageTemplate string  `toml:"message_template,omitempty" mapstructure:"message_template,omitempty"`
+	// BranchPrefix replaces DefBranchPrefix in the names of Dura branches
+	BranchPrefix string `toml:"branch_prefix,omitempty" mapstructure:"branch_prefix,omitempty"`
+	// Retention overrides the retention rules for the repositories of this watch
+	Retention *RetentionOverride `toml:"retention,omitempty" mapstructure:"retention,omitempty"`
+	// BackupRemote overrides backup.remote for the repositories of this watch, an empty
+	// value disables their backup
+	BackupRemote *string `toml:"backup_remote,omitempty" mapstructure:"backup_remote,omitempty"`
+	// Shadow overrides commit.shadow for the repositories of this watch
+	Shadow *bool `toml:"shadow,omitempty" mapstructure:"shadow,omitempty"`
 }
 
 func NewWatchConfig() (wc *WatchConfig) {
@@ -110,33 +226,187 @@ func NewWatchConfig() (wc *WatchConfig) {
 	return &WatchConfig{
 		Include:  []string{},
 		Exclude:  []string{},
-		MaxDepth: 255,
+		MaxDepth: DefMaxDepth,
+	}
+}
+
+// mergeOverrides sets the overrides given in overrides (author, email, message template,
+// branch prefix, retention, backup remote and shadow) on wc, changed reports whether
+// any was given. Include, exclude and max depth are left as they are.
+func (wc *WatchConfig) mergeOverrides(overrides WatchConfig) (changed bool) {
+	if overrides.Author != nil {
+		wc.Author, changed = overrides.Author, true
+	}
+	if overrides.Email != nil {
+		wc.Email, changed = overrides.Email, true
+	}
+	if overrides.MessageTemplate != "" {
+		wc.MessageTemplate, changed = overrides.MessageTemplate, true
+	}
+	if overrides.BranchPrefix != "" {
+		wc.BranchPrefix, changed = overrides.BranchPrefix, true
+	}
+	if r := overrides.Retention; r != nil {
+		merged := RetentionOverride{}
+		if wc.Retention != nil {
+			merged = *wc.Retention
+		}
+		if r.KeepAllHours != nil {
+			merged.KeepAllHours = r.KeepAllHours
+		}
+		if r.KeepHourly != nil {
+			merged.KeepHourly = r.KeepHourly
+		}
+		if r.KeepDaily != nil {
+			merged.KeepDaily = r.KeepDaily
+		}
+		if r.KeepWeekly != nil {
+			merged.KeepWeekly = r.KeepWeekly
+		}
+		wc.Retention, changed = &merged, true
+	}
+	if overrides.BackupRemote != nil {
+		wc.BackupRemote, changed = overrides.BackupRemote, true
 	}
+	if overrides.Shadow != nil {
+		wc.Shadow, changed = overrides.Shadow, true
+	}
+	return
 }
 
 type Config struct {
 	Dura         DuraConfig             `toml:"dura"`
 	Commit       CommitConfig           `toml:"commit"`
+	Retention    RetentionConfig        `toml:"retention" mapstructure:"retention"`
+	GC           GCConfig               `toml:"gc" mapstructure:"gc"`
+	Backup       BackupConfig           `toml:"backup" mapstructure:"backup"`
 	Repositories map[string]WatchConfig `toml:"repos" mapstructure:"repos"`
 }
 
+const (
+	// AuthorTimeCapture records the capture time as the author time of snapshots
+	AuthorTimeCapture = "capture"
+	// AuthorTimeMtime records the newest modification time of the changed files as the
+	// author time of snapshots
+	AuthorTimeMtime = "mtime"
+)
+
+const (
+	// ModePoll captures every watched repository each dura.sleep_seconds
+	ModePoll = "poll"
+	// ModeWatch captures a repository once its working tree changes
+	ModeWatch = "watch"
+)
+
 type DuraConfig struct {
-	SleepSeconds int `toml:"sleep_seconds" mapstructure:"sleep_seconds"`
+	SleepSeconds   int    `toml:"sleep_seconds" mapstructure:"sleep_seconds"`
+	Mode           string `toml:"mode" mapstructure:"mode"`
+	DebounceMillis int    `toml:"debounce_millis" mapstructure:"debounce_millis"`
+	LogFile        string `toml:"log_file" mapstructure:"log_file"`
+	LogLevel       string `toml:"log_level" mapstructure:"log_level"`
+	LogMaxSizeMB   int    `toml:"log_max_size_mb" mapstructure:"log_max_size_mb"`
+	LogMaxAgeDays  int    `toml:"log_max_age_days" mapstructure:"log_max_age_days"`
+	LogMaxBackups  int    `toml:"log_max_backups" mapstructure:"log_max_backups"`
+	LogCompress    bool   `toml:"log_compress" mapstructure:"log_compress"`
 }
 
 type CommitConfig struct {
-	Author           *string `toml:"author"`
-	Email            *string `toml:"email"`
-	ExcludeGitConfig bool    `toml:"exclude_git_config"`
+	Author           *string `toml:"author" mapstructure:"author"`
+	Email            *string `toml:"email" mapstructure:"email"`
+	ExcludeGitConfig bool    `toml:"exclude_git_config" mapstructure:"exclude_git_config"`
+	// AuthorTime is either AuthorTimeCapture or AuthorTimeMtime
+	AuthorTime string `toml:"author_time" mapstructure:"author_time"`
+	// MessageTemplate is a text/template rendered with MessageData, DefMessageTemplate if empty
+	MessageTemplate string `toml:"message_template" mapstructure:"message_template"`
+	// RefNamespace is where Dura refs are stored, DefRefNamespace (branches) if empty
+	RefNamespace string `toml:"ref_namespace" mapstructure:"ref_namespace"`
+	// PreviousRefNamespaces are the namespaces RefNamespace was set to before, the Dura
+	// refs left in them are still read and migrated
+	PreviousRefNamespaces []string `toml:"previous_ref_namespaces" mapstructure:"previous_ref_namespaces"`
+	// RefPattern names Dura refs within RefNamespace, DefRefPattern if empty
+	RefPattern string `toml:"ref_pattern" mapstructure:"ref_pattern"`
+	// Lineage links the first snapshot after HEAD moves to the previous snapshot
+	Lineage bool `toml:"lineage" mapstructure:"lineage"`
+	// Shadow keeps the snapshot objects and Dura refs in a shadow repository in the Dura
+	// cache directory instead of the repository itself
+	Shadow bool `toml:"shadow" mapstructure:"shadow"`
+}
+
+// RetentionConfig decides which snapshots dura prune keeps, the newest snapshot of each
+// period is kept for the given number of most recent periods having snapshots. Rules
+// set to 0 keep nothing, when all are 0 (the default) every snapshot is kept.
+type RetentionConfig struct {
+	// KeepAllHours keeps every snapshot taken within the last KeepAllHours hours
+	KeepAllHours int `toml:"keep_all_hours" mapstructure:"keep_all_hours"`
+	KeepHourly   int `toml:"keep_hourly" mapstructure:"keep_hourly"`
+	KeepDaily    int `toml:"keep_daily" mapstructure:"keep_daily"`
+	KeepWeekly   int `toml:"keep_weekly" mapstructure:"keep_weekly"`
+	// PruneIntervalHours makes the daemon prune every watched repository this often, 0
+	// disables automatic pruning
+	PruneIntervalHours int `toml:"prune_interval_hours" mapstructure:"prune_interval_hours"`
+}
+
+// RetentionOverride replaces the retention rules which are set for the repositories of
+// a watch, the others keep their global value.
+type RetentionOverride struct {
+	KeepAllHours *int `toml:"keep_all_hours,omitempty" mapstructure:"keep_all_hours,omitempty"`
+	KeepHourly   *int `toml:"keep_hourly,omitempty" mapstructure:"keep_hourly,omitempty"`
+	KeepDaily    *int `toml:"keep_daily,omitempty" mapstructure:"keep_daily,omitempty"`
+	KeepWeekly   *int `toml:"keep_weekly,omitempty" mapstructure:"keep_weekly,omitempty"`
+}
+
+// GCConfig configures dura gc.
+type GCConfig struct {
+	// Branches are the branches (or any revisions) whose history makes Dura refs fully
+	// committed, DefGCBranches if empty
+	Branches []string `toml:"branches" mapstructure:"branches"`
+	// Archive moves collected Dura refs to ArchiveRefNamespace instead of deleting them
+	Archive bool `toml:"archive" mapstructure:"archive"`
+	// PruneExpireDays is the age loose objects must reach before dura gc --prune-objects
+	// removes them when unreachable
+	PruneExpireDays int `toml:"prune_expire_days" mapstructure:"prune_expire_days"`
+}
+
+// BackupConfig configures the push of the Dura refs to a backup remote.
+type BackupConfig struct {
+	// Remote is the name of a remote of the repository or the URL of a repository the
+	// Dura refs are pushed to, backups are disabled if empty
+	Remote string `toml:"remote" mapstructure:"remote"`
+	// OnCapture pushes the Dura refs of a repository after each capture creating a snapshot
+	OnCapture bool `toml:"on_capture" mapstructure:"on_capture"`
+	// IntervalMinutes makes the daemon push every watched repository this often, 0
+	// disables scheduled backups
+	IntervalMinutes int `toml:"interval_minutes" mapstructure:"interval_minutes"`
+	// Retries is the number of times a failed push is retried, waiting RetrySeconds
+	// before the first retry and twice as long before each of the next ones
+	Retries      int `toml:"retries" mapstructure:"retries"`
+	RetrySeconds int `toml:"retry_seconds" mapstructure:"retry_seconds"`
 }
 
 func (c *Config) Empty() {
 	log.Trace().Msg("entered Empty")
 	log.Trace().Msg("emptying configuration")
-	c.Dura.SleepSeconds = 5
+	c.Dura.SleepSeconds = DefSleepSeconds
+	c.Dura.Mode = DefMode
+	c.Dura.DebounceMillis = DefDebounceMillis
+	c.Dura.LogFile = ""
+	c.Dura.LogLevel = DefLogLevel
+	c.Dura.LogMaxSizeMB = DefLogMaxSizeMB
+	c.Dura.LogMaxAgeDays = DefLogMaxAgeDays
+	c.Dura.LogMaxBackups = DefLogMaxBackups
+	c.Dura.LogCompress = DefLogCompress
 	c.Commit.ExcludeGitConfig = false
 	c.Commit.Author = nil
 	c.Commit.Email = nil
+	c.Commit.AuthorTime = AuthorTimeCapture
+	c.Commit.MessageTemplate = ""
+	c.Commit.RefNamespace = DefRefNamespace
+	c.Commit.RefPattern = DefRefPattern
+	c.Commit.Lineage = false
+	c.Commit.Shadow = false
+	c.Retention = RetentionConfig{}
+	c.GC = GCConfig{Branches: DefGCBranches, PruneExpireDays: DefPruneExpireDays}
+	c.Backup = BackupConfig{OnCapture: true, Retries: DefBackupRetries, RetrySeconds: DefBackupRetrySeconds}
 	c.Repositories = map[string]WatchConfig{}
 	log.Trace().Msg("emptied configuration")
 	log.Trace().Msgf("leaving Empty")
@@ -182,6 +452,8 @@ func (c *Config) LoadFile(filepath string) (err error) {
 
 func (c *Config) Save() (err error) {
 	log.Trace().Msg("entered Save")
+	log.Trace().Msg("syncing watched repositories to viper")
+	viper.Set("repos", c.repoSettings())
 	if err = viper.WriteConfig(); err != nil {
 		log.Error().Err(err).Msg("error encountered attempting to save configuration")
 		return
@@ -230,22 +502,33 @@ func (c *Config) SetWatch(path string, cfg WatchConfig) (err error) {
 		log.Error().Err(err).Msg("path given is not a directory")
 		return
 	}
-	log.Debug().Msgf("path 5s is a directory, can proceed", path)
-	log.Trace().Msg("check if directory (path)  is a git repository")
-	if isRepo, err = IsRepo(path); err != nil || !isRepo {
-		if err == nil {
-			err = errors.New(fmt.Sprintf("%s is not a repo", path))
+	log.Debug().Msgf("path %s is a directory, can proceed", path)
+	if cfg.BranchPrefix != "" {
+		log.Trace().Str("branchPrefix", cfg.BranchPrefix).Msg("checking that branch prefix forms valid branch names")
+		if valid, _ := git.ReferenceNameIsValid(fmt.Sprintf("refs/heads/%s/0", cfg.BranchPrefix)); !valid {
+			err = fmt.Errorf("branch prefix '%s' does not form valid branch names", cfg.BranchPrefix)
+			log.Error().Err(err).Msg("invalid branch prefix")
+			return
 		}
-		log.Error().Err(err).Msgf("error encountered testing directory %s", path)
+	}
+	log.Trace().Msgf("resolve absolute path of %s", path)
+	if path, err = filepath.Abs(path); err != nil {
+		log.Error().Err(err).Msg("error encountered attempting to resolve absolute path")
 		return
 	}
-	log.Debug().Msgf("directory %s is a git repository, can proceed", path)
+	log.Trace().Msg("check if directory (path) is a git repository")
+	if isRepo = isWorktree(path); isRepo {
+		log.Debug().Msgf("directory %s is a git repository", path)
+	} else {
+		log.Info().Msgf("directory %s is not a git repository, repositories within it will be discovered up to a depth of %d", path, cfg.MaxDepth)
+	}
 	log.Trace().Msg("check that repository hasn't already been added")
 	if c.Repositories != nil {
 		log.Trace().Msg("repositories exist in configuration (i.e. non-nil)")
 		var ok bool
 		log.Trace().Msg("check if path already exists in the configuration")
-		if _, ok = c.Repositories[path]; !ok {
+		var existing WatchConfig
+		if existing, ok = c.Repositories[path]; !ok {
 			log.Trace().Msg("add path to repositories watched")
 			c.Repositories[path] = cfg
 			log.Trace().Msg("save configuration after repository update")
@@ -254,8 +537,17 @@ func (c *Config) SetWatch(path string, cfg WatchConfig) (err error) {
 				return
 			}
 			log.Info().Msgf("now watching %s", path)
+		} else if existing.mergeOverrides(cfg) {
+			log.Trace().Msg("apply overrides to watched repository")
+			c.Repositories[path] = existing
+			log.Trace().Msg("save configuration after repository update")
+			if err = c.Save(); err != nil {
+				log.Error().Err(err).Msg("error encountered attempting to save configuration after repository update")
+				return
+			}
+			log.Info().Msgf("%s is already being watched, updated its overrides", path)
 		} else {
-			log.Warn().Msgf("%s is already being watched")
+			log.Warn().Msgf("%s is already being watched", path)
 		}
 	} else {
 		log.Trace().Msg("initialize configuration repositories map")
@@ -287,7 +579,13 @@ func (c *Config) SetUnwatch(path string) (err error) {
 		log.Error().Err(err).Msg("path given is not a directory")
 		return
 	}
-	log.Debug().Msgf("path 5s is a directory, can proceed", path)
+	log.Debug().Msgf("path %s is a directory, can proceed", path)
+	if _, ok := c.Repositories[path]; !ok {
+		log.Trace().Msgf("%s is not watched as given, trying its absolute path", path)
+		if abs, absErr := filepath.Abs(path); absErr == nil {
+			path = abs
+		}
+	}
 	if c.Repositories != nil {
 		log.Trace().Msg("repositories exist in configuration (i.e. non-nil)")
 		var ok bool
@@ -322,6 +620,153 @@ func (c *Config) SetUnwatch(path string) (err error) {
 	return
 }
 
+// SetRefNamespace sets and saves commit.ref_namespace, where new Dura refs are created.
+// The namespace it replaces is added to commit.previous_ref_namespaces, so the Dura refs
+// not yet migrated out of it are still found.
+func (c *Config) SetRefNamespace(namespace string) (err error) {
+	log.Trace().Msg("entered SetRefNamespace")
+	namespace = strings.TrimRight(namespace, "/")
+	if valid, _ := git.ReferenceNameIsValid(fmt.Sprintf("%s/0", namespace)); !valid || !strings.HasPrefix(namespace, "refs/") {
+		err = fmt.Errorf("'%s' is not a valid ref namespace", namespace)
+		log.Error().Err(err).Msg("error encountered while setting ref namespace")
+		return
+	}
+	previous := strings.TrimRight(c.Commit.RefNamespace, "/")
+	if previous == "" {
+		previous = DefRefNamespace
+	}
+	var previousNamespaces []string
+	for _, ns := range append(c.Commit.PreviousRefNamespaces, previous) {
+		if ns != namespace && !containsString(previousNamespaces, ns) {
+			previousNamespaces = append(previousNamespaces, ns)
+		}
+	}
+	c.Commit.RefNamespace = namespace
+	c.Commit.PreviousRefNamespaces = previousNamespaces
+	viper.Set("commit.ref_namespace", namespace)
+	viper.Set("commit.previous_ref_namespaces", previousNamespaces)
+	if err = c.Save(); err != nil {
+		log.Error().Err(err).Msg("error encountered while saving configuration")
+		return
+	}
+	log.Debug().Str("namespace", namespace).Msg("ref namespace set")
+	log.Trace().Msg("leaving SetRefNamespace")
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchConfigFor returns the watch configuration that applies to path, see WatchRootFor.
+// If path is not watched the default watch configuration is returned.
+func (c *Config) WatchConfigFor(path string) (wc WatchConfig) {
+	log.Trace().Msg("entered WatchConfigFor")
+	var ok bool
+	if _, wc, ok = c.WatchRootFor(path); !ok {
+		log.Debug().Str("path", path).Msg("path is not watched, using default watch configuration")
+		wc = *NewWatchConfig()
+	}
+	log.Trace().Msg("leaving WatchConfigFor")
+	return
+}
+
+// WatchRootFor finds the watched directory containing path, which is either the path
+// itself or the closest of its parent directories that is watched. Paths are compared
+// in their absolute form, ok is false if path is not within any watched directory.
+func (c *Config) WatchRootFor(path string) (root string, wc WatchConfig, ok bool) {
+	log.Trace().Msg("entered WatchRootFor")
+	var (
+		abs    string
+		absErr error
+	)
+	if abs, absErr = filepath.Abs(path); absErr != nil {
+		log.Error().Err(absErr).Msgf("error encountered attempting to resolve absolute path of %s", path)
+		return
+	}
+	for repo, repoWc := range c.Repositories {
+		var repoAbs string
+		if repoAbs, absErr = filepath.Abs(repo); absErr != nil {
+			continue
+		}
+		if abs != repoAbs && !strings.HasPrefix(abs, strings.TrimRight(repoAbs, string(filepath.Separator))+string(filepath.Separator)) {
+			continue
+		}
+		if !ok || len(repoAbs) > len(root) {
+			root, wc, ok = repoAbs, repoWc, true
+		}
+	}
+	log.Debug().Str("path", path).Str("root", root).Bool("watched", ok).Msg("watch root lookup complete")
+	log.Trace().Msg("leaving WatchRootFor")
+	return
+}
+
+// repoSettings converts the watched repositories to the plain maps viper writes out,
+// leaving out unset overrides.
+func (c *Config) repoSettings() (repos map[string]interface{}) {
+	repos = map[string]interface{}{}
+	for path, wc := range c.Repositories {
+		settings := map[string]interface{}{
+			"include":   append([]string{}, wc.Include...),
+			"exclude":   append([]string{}, wc.Exclude...),
+			"max_depth": wc.MaxDepth,
+		}
+		if wc.Author != nil {
+			settings["author"] = *wc.Author
+		}
+		if wc.Email != nil {
+			settings["email"] = *wc.Email
+		}
+		if wc.MessageTemplate != "" {
+			settings["message_template"] = wc.MessageTemplate
+		}
+		if wc.BranchPrefix != "" {
+			settings["branch_prefix"] = wc.BranchPrefix
+		}
+		if wc.Retention != nil {
+			retention := map[string]interface{}{}
+			for key, value := range map[string]*int{
+				"keep_all_hours": wc.Retention.KeepAllHours,
+				"keep_hourly":    wc.Retention.KeepHourly,
+				"keep_daily":     wc.Retention.KeepDaily,
+				"keep_weekly":    wc.Retention.KeepWeekly,
+			} {
+				if value != nil {
+					retention[key] = *value
+				}
+			}
+			settings["retention"] = retention
+		}
+		if wc.BackupRemote != nil {
+			settings["backup_remote"] = *wc.BackupRemote
+		}
+		if wc.Shadow != nil {
+			settings["shadow"] = *wc.Shadow
+		}
+		repos[path] = settings
+	}
+	return
+}
+
+// BranchPrefixes returns every prefix Dura branches may be named with, DefBranchPrefix
+// along with the branch prefixes of all watched directories.
+func (c *Config) BranchPrefixes() (prefixes []string) {
+	prefixes = []string{DefBranchPrefix}
+	seen := map[string]bool{DefBranchPrefix: true}
+	for _, wc := range c.Repositories {
+		if wc.BranchPrefix != "" && !seen[wc.BranchPrefix] {
+			seen[wc.BranchPrefix] = true
+			prefixes = append(prefixes, wc.BranchPrefix)
+		}
+	}
+	return
+}
+
 func (c *Config) GitRepos() (repos map[string]WatchConfig) {
 	log.Trace().Msg("returning repositories from configuration")
 	return c.Repositories
@@ -0,0 +1,288 @@
+package dura
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ControlStatus returns the daemon's status
+	ControlStatus = "status"
+	// ControlCapture captures the repository named in the request straight away
+	ControlCapture = "capture"
+	// ControlPause stops the daemon from capturing until ControlResume is received
+	ControlPause = "pause"
+	// ControlResume resumes capturing after ControlPause
+	ControlResume = "resume"
+	// ControlReload re-reads the configuration file
+	ControlReload = "reload"
+	// ControlShutdown asks the daemon to shut down gracefully
+	ControlShutdown = "shutdown"
+)
+
+var (
+	controlSocketName = "control.sock"
+	// controlTimeout bounds how long either side waits to read or write a message
+	controlTimeout = 5 * time.Second
+	// controlCaptureTimeout bounds how long a client waits for a capture to complete
+	controlCaptureTimeout = 5 * time.Minute
+	// captureMu serializes captures made by the daemon loop and control requests
+	captureMu sync.Mutex
+	paused    int32
+	startedAt time.Time
+	rescans   = make(chan struct{}, 1)
+)
+
+// ControlRequest is a single request sent to the daemon's control socket, encoded as one
+// line of JSON.
+type ControlRequest struct {
+	Command string `json:"command"`
+	Repo    string `json:"repo,omitempty"`
+}
+
+// ControlResponse is the daemon's reply to a ControlRequest, encoded as one line of JSON.
+type ControlResponse struct {
+	Ok      bool           `json:"ok"`
+	Error   string         `json:"error,omitempty"`
+	Status  *DaemonStatus  `json:"status,omitempty"`
+	Capture *CaptureStatus `json:"capture,omitempty"`
+}
+
+// DaemonStatus describes the running daemon.
+type DaemonStatus struct {
+	Pid        uint32    `json:"pid"`
+	StartedAt  time.Time `json:"started_at"`
+	Paused     bool      `json:"paused"`
+	Mode       string    `json:"mode"`
+	ConfigFile string    `json:"config_file"`
+	// Repos is only set in responses, GetStatus moves it to Status.Repos
+	Repos []RepoStatus `json:"repos,omitempty"`
+}
+
+// ControlSocketPath returns the path of the daemon's control socket, which lives in the
+// cache directory next to the runtime database.
+func ControlSocketPath() string {
+	return filepath.Join(cacheHome, controlSocketName)
+}
+
+// isPaused reports whether captures are paused.
+func isPaused() bool {
+	return atomic.LoadInt32(&paused) == 1
+}
+
+func setPaused(p bool) {
+	var v int32
+	if p {
+		v = 1
+	}
+	atomic.StoreInt32(&paused, v)
+}
+
+// requestRescan asks the file system watcher (if running) to rediscover repositories.
+func requestRescan() {
+	select {
+	case rescans <- struct{}{}:
+	default:
+	}
+}
+
+// startControlServer listens on the control socket and serves requests until a shutdown
+// is requested. It must only be called while holding the runtime lock, as any socket file
+// left behind by a previous daemon is removed.
+func startControlServer() (err error) {
+	log.Trace().Msg("entered startControlServer")
+	path := ControlSocketPath()
+	logger := log.With().Str("socket", path).Logger()
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Error().Err(err).Msg("error encountered while removing stale control socket")
+		return
+	}
+	var listener net.Listener
+	if listener, err = net.Listen("unix", path); err != nil {
+		logger.Error().Err(err).Msg("error encountered while listening on control socket")
+		return
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		logger.Error().Err(err).Msg("error encountered while restricting control socket permissions")
+		listener.Close()
+		return
+	}
+	go func() {
+		<-shutdown
+		listener.Close()
+		os.Remove(path)
+	}()
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				if shuttingDown() {
+					return
+				}
+				logger.Error().Err(acceptErr).Msg("error encountered while accepting control connection")
+				time.Sleep(controlTimeout / 10)
+				continue
+			}
+			go serveControl(conn)
+		}
+	}()
+	logger.Info().Msg("control socket listening")
+	log.Trace().Msg("leaving startControlServer")
+	return
+}
+
+// serveControl answers the single request sent over conn, after checking that the peer
+// runs as the same user as the daemon.
+func serveControl(conn net.Conn) {
+	defer conn.Close()
+	var (
+		req  ControlRequest
+		resp ControlResponse
+		uid  int
+		err  error
+	)
+	if uid, err = peerUID(conn); err != nil || uid != os.Getuid() {
+		if err == nil {
+			err = fmt.Errorf("peer uid %d does not own the daemon", uid)
+		}
+		log.Warn().Err(err).Msg("rejecting control connection")
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(controlTimeout))
+	if err = json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		log.Warn().Err(err).Msg("error encountered while reading control request")
+		return
+	}
+	log.Debug().Str("command", req.Command).Str("repo", req.Repo).Msg("control request received")
+	resp = handleControl(req)
+	conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+	if err = json.NewEncoder(conn).Encode(&resp); err != nil {
+		log.Warn().Err(err).Msg("error encountered while writing control response")
+	}
+}
+
+func handleControl(req ControlRequest) (resp ControlResponse) {
+	var err error
+	switch req.Command {
+	case ControlStatus:
+		settings := currentConfig()
+		pid := uint32(os.Getpid())
+		if runtimeLock.Pid != nil {
+			pid = *runtimeLock.Pid
+		}
+		resp.Status = &DaemonStatus{
+			Pid:        pid,
+			StartedAt:  startedAt,
+			Paused:     isPaused(),
+			Mode:       settings.Dura.Mode,
+			ConfigFile: settings.DefaultPath(),
+			Repos:      repoStatuses(),
+		}
+	case ControlCapture:
+		if req.Repo == "" {
+			err = errors.New("capture requires a repository path")
+			break
+		}
+		captureMu.Lock()
+		start := time.Now()
+		resp.Capture, err = Capture(req.Repo)
+		recordCapture(req.Repo, resp.Capture, err, time.Since(start))
+		captureMu.Unlock()
+		if resp.Capture != nil && err == nil {
+			backupAfterCapture(req.Repo, true)
+		}
+	case ControlPause:
+		setPaused(true)
+		log.Info().Msg("captures paused")
+	case ControlResume:
+		setPaused(false)
+		log.Info().Msg("captures resumed")
+	case ControlReload:
+		if err = ReloadConfig(); err == nil {
+			requestRescan()
+		}
+	case ControlShutdown:
+		RequestShutdown()
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Ok = true
+	}
+	return
+}
+
+// CallDaemon sends req to the running daemon's control socket and returns its response.
+// ErrNoDaemon is returned if no daemon is listening. A daemon that handled the request
+// but failed to carry it out is reported as an error as well.
+func CallDaemon(req ControlRequest) (resp *ControlResponse, err error) {
+	log.Trace().Msg("entered CallDaemon")
+	var conn net.Conn
+	if conn, err = net.DialTimeout("unix", ControlSocketPath(), controlTimeout); err != nil {
+		log.Debug().Err(err).Msg("unable to connect to control socket")
+		err = ErrNoDaemon
+		return
+	}
+	defer conn.Close()
+	timeout := controlTimeout
+	if req.Command == ControlCapture {
+		timeout = controlCaptureTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err = json.NewEncoder(conn).Encode(&req); err != nil {
+		log.Error().Err(err).Msg("error encountered while writing control request")
+		return
+	}
+	resp = &ControlResponse{}
+	if err = json.NewDecoder(bufio.NewReader(conn)).Decode(resp); err != nil {
+		log.Error().Err(err).Msg("error encountered while reading control response")
+		resp = nil
+		return
+	}
+	if !resp.Ok {
+		err = errors.New(resp.Error)
+	}
+	log.Trace().Msg("leaving CallDaemon")
+	return
+}
+
+// CaptureVia captures the repository at path through the running daemon, so captures
+// never race with the daemon's own, falling back to a direct Capture when no daemon is
+// running or it can't be reached.
+func CaptureVia(path string) (cs *CaptureStatus, err error) {
+	log.Trace().Msg("entered CaptureVia")
+	var (
+		abs  string
+		resp *ControlResponse
+	)
+	if abs, err = filepath.Abs(path); err != nil {
+		return
+	}
+	if resp, err = CallDaemon(ControlRequest{Command: ControlCapture, Repo: abs}); err == nil {
+		log.Debug().Str("path", abs).Msg("captured through daemon")
+		return resp.Capture, nil
+	}
+	if resp != nil {
+		// The daemon carried out the capture, which failed
+		return
+	}
+	if !errors.Is(err, ErrNoDaemon) {
+		log.Warn().Err(err).Msg("unable to capture through daemon, capturing directly")
+	}
+	if cs, err = Capture(path); cs != nil && err == nil {
+		backupAfterCapture(abs, false)
+	}
+	log.Trace().Msg("leaving CaptureVia")
+	return
+}
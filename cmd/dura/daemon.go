@@ -0,0 +1,140 @@
+package dura
+
+import (
+	"errors"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrNoDaemon is returned when an operation requires a running Dura daemon
+	ErrNoDaemon = errors.New("no Dura daemon is running")
+	// ErrDaemonPidUnknown is returned when the runtime lock is held by a daemon which
+	// hasn't recorded its PID, while it starts or releases the lock
+	ErrDaemonPidUnknown = errors.New("the Dura daemon holding the runtime lock hasn't recorded its PID")
+	shutdown            = make(chan struct{})
+	shutdownOnce        sync.Once
+	// killPollInterval is how often KillDaemon checks whether the daemon has exited
+	killPollInterval = 100 * time.Millisecond
+)
+
+// RequestShutdown asks the running daemon loop to stop once any in-flight capture has
+// finished. It is safe to call more than once and from any goroutine.
+func RequestShutdown() {
+	shutdownOnce.Do(func() {
+		log.Info().Msg("shutdown requested")
+		close(shutdown)
+	})
+}
+
+// shuttingDown reports whether RequestShutdown has been called.
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleSignals requests a shutdown when the process receives SIGTERM or SIGINT.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Info().Str("signal", sig.String()).Msg("received signal, shutting down after in-flight captures")
+		RequestShutdown()
+	}()
+}
+
+// KillDaemon asks the daemon holding the runtime lock to shut down gracefully, through
+// the control socket or with SIGTERM if the socket can't be reached, and waits up to
+// timeout for it to exit. If it is still running after that and force is set the daemon
+// is killed outright, after which its PID is cleared from the runtime database.
+// The PID of the daemon is returned, ErrNoDaemon if none is running.
+func KillDaemon(timeout time.Duration, force bool) (pid uint32, err error) {
+	log.Trace().Msg("entered KillDaemon")
+	var holder *uint32
+	if holder, err = runtimeLock.Holder(); err != nil {
+		log.Error().Err(err).Msg("error encountered while retrieving runtime lock holder")
+		return
+	}
+	if holder == nil {
+		err = ErrNoDaemon
+		return
+	}
+	pid = *holder
+	// Signalling PID 0 would signal the process group of this process
+	if pid == 0 {
+		err = ErrDaemonPidUnknown
+		return
+	}
+	if pid == uint32(os.Getpid()) {
+		err = errors.New("refusing to kill the current process")
+		return
+	}
+	logger := log.With().Uint32("pid", pid).Logger()
+	logger.Debug().Msg("requesting daemon shutdown")
+	if _, err = CallDaemon(ControlRequest{Command: ControlShutdown}); err != nil {
+		logger.Debug().Err(err).Msg("unable to request shutdown through control socket, signalling daemon")
+		err = terminateProcess(pid)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("error encountered while requesting daemon shutdown")
+		if !force {
+			return
+		}
+	} else if waitForExit(pid, timeout) {
+		logger.Info().Msg("daemon shut down")
+		return
+	}
+	if !force {
+		err = errors.New("timed out waiting for the Dura daemon to exit")
+		logger.Error().Err(err).Dur("timeout", timeout).Msg("daemon still running")
+		return
+	}
+	logger.Warn().Msg("killing daemon")
+	var proc *os.Process
+	if proc, err = os.FindProcess(int(pid)); err == nil {
+		err = proc.Kill()
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("error encountered while killing daemon")
+		return
+	}
+	if !waitForExit(pid, timeout) {
+		err = errors.New("Dura daemon is still running after being killed")
+		logger.Error().Err(err).Msg("daemon still running")
+		return
+	}
+	logger.Debug().Msg("clearing PID of killed daemon from runtime database")
+	if err = runtimeLock.Load(); err == nil && runtimeLock.Pid != nil && *runtimeLock.Pid == pid {
+		runtimeLock.Pid = nil
+		err = runtimeLock.Save()
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("unable to clear PID of killed daemon from runtime database")
+		err = nil
+	}
+	logger.Info().Msg("daemon killed")
+	log.Trace().Msg("leaving KillDaemon")
+	return
+}
+
+// waitForExit polls until the process with the given PID has exited, reporting false if
+// it is still alive once timeout has passed.
+func waitForExit(pid uint32, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(killPollInterval)
+	}
+	return true
+}
@@ -140,8 +140,15 @@ func (rl *RuntimeLock) Save() (err error) {
 	log.Trace().Msgf("setting runtime database PID: %v", rl.Pid)
 	dbViper.Set("pid", rl.Pid)
 	if err = dbViper.WriteConfig(); err != nil {
-		log.Error().Err(err).Msg("error encountered attempting to save runtime database")
-		return
+		if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound {
+			log.Error().Err(err).Msg("error encountered attempting to save runtime database")
+			return
+		}
+		log.Debug().Msgf("runtime database does not exist yet, creating %s", cacheFile)
+		if err = dbViper.WriteConfigAs(cacheFile); err != nil {
+			log.Error().Err(err).Msgf("error encountered attempting to create runtime database %s", cacheFile)
+			return
+		}
 	}
 	log.Debug().Msg("successfully saved configuration after setting PID")
 	log.Trace().Msg("leaving Save")
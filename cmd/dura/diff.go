@@ -0,0 +1,149 @@
+package dura
+
+import (
+	"errors"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+const (
+	// DiffWorktree selects the working tree (as Dura would capture it) as a side of a diff
+	DiffWorktree = "worktree"
+	// DiffHead selects the commit checked out in the repository as a side of a diff
+	DiffHead = "HEAD"
+)
+
+const (
+	// DiffFormatPatch prints a unified patch
+	DiffFormatPatch = "patch"
+	// DiffFormatStat prints a diffstat
+	DiffFormatStat = "stat"
+	// DiffFormatNameStatus prints the status and path of every changed file
+	DiffFormatNameStatus = "name-status"
+)
+
+// DiffSnapshots compares two states of repo and returns the differences in the given
+// format. Each of from and to may be a snapshot (hash or time, see ResolveSnapshot),
+// DiffHead or DiffWorktree. An empty from selects the newest snapshot and an empty to
+// the working tree. The working tree is read into a private index the same way Capture
+// builds snapshots, so watch configuration filters apply to it.
+func DiffSnapshots(repo *git.Repository, from string, to string, format string) (out []byte, err error) {
+	log.Trace().Msg("entered DiffSnapshots")
+	logger := log.With().Str("repo", repo.Path()).Str("from", from).Str("to", to).Logger()
+	var (
+		fromTree, toTree *git.Tree
+		diff             *git.Diff
+		diffOpts         git.DiffOptions
+		now              = time.Now()
+	)
+	if to == "" {
+		to = DiffWorktree
+	}
+	if from == "" {
+		var latest *git.Commit
+		if latest, err = LatestSnapshot(repo, now); err != nil {
+			return
+		}
+		from = latest.Id().String()
+	}
+	if isWorktreeSide(from) && isWorktreeSide(to) {
+		err = errors.New("at most one side of a diff can be the working tree")
+		return
+	}
+	if fromTree, err = resolveDiffSide(repo, from, now); err != nil {
+		return
+	}
+	if toTree, err = resolveDiffSide(repo, to, now); err != nil {
+		return
+	}
+	if diffOpts, err = git.DefaultDiffOptions(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while attempting to set diff options")
+		return
+	}
+	switch {
+	case isWorktreeSide(to):
+		logger.Trace().Msg("diffing tree against working tree")
+		diff, err = diffTreeToWorktree(repo, fromTree, &diffOpts)
+	case isWorktreeSide(from):
+		logger.Trace().Msg("diffing working tree against tree")
+		diffOpts.Flags |= git.DiffReverse
+		diff, err = diffTreeToWorktree(repo, toTree, &diffOpts)
+	default:
+		logger.Trace().Msg("diffing tree against tree")
+		diff, err = repo.DiffTreeToTree(fromTree, toTree, &diffOpts)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("error encountered while diffing")
+		return
+	}
+	defer diff.Free()
+	switch format {
+	case "", DiffFormatPatch:
+		out, err = diff.ToBuf(git.DiffFormatPatch)
+	case DiffFormatNameStatus:
+		out, err = diff.ToBuf(git.DiffFormatNameStatus)
+	case DiffFormatStat:
+		var (
+			stats *git.DiffStats
+			s     string
+		)
+		if stats, err = diff.Stats(); err != nil {
+			break
+		}
+		defer stats.Free()
+		if s, err = stats.String(git.DiffStatsFull, 80); err == nil {
+			out = []byte(s)
+		}
+	default:
+		err = fmt.Errorf("unknown diff format %q", format)
+	}
+	log.Trace().Msg("leaving DiffSnapshots")
+	return
+}
+
+func isWorktreeSide(side string) bool {
+	return strings.EqualFold(side, DiffWorktree)
+}
+
+// resolveDiffSide returns the tree selected by side, nil for the working tree.
+func resolveDiffSide(repo *git.Repository, side string, now time.Time) (tree *git.Tree, err error) {
+	var commit *git.Commit
+	switch {
+	case isWorktreeSide(side):
+		return
+	case side == DiffHead:
+		commit, err = headPeelToCommit(repo)
+	default:
+		commit, err = ResolveSnapshot(repo, side, now)
+	}
+	if err != nil {
+		return
+	}
+	return commit.Tree()
+}
+
+// diffTreeToWorktree diffs tree against the working tree of repo by building a snapshot
+// index, as Capture does, and comparing the tree to that index.
+func diffTreeToWorktree(repo *git.Repository, tree *git.Tree, opts *git.DiffOptions) (diff *git.Diff, err error) {
+	var (
+		head   *git.Commit
+		index  *git.Index
+		unborn bool
+	)
+	if unborn, err = repo.IsHeadUnborn(); err != nil {
+		return
+	}
+	if !unborn {
+		if head, err = headPeelToCommit(repo); err != nil {
+			return
+		}
+	}
+	if index, err = snapshotIndex(repo, head, filterFor(repo.Workdir())); err != nil {
+		return
+	}
+	defer index.Free()
+	return repo.DiffTreeToIndex(tree, index, opts)
+}
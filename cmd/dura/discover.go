@@ -0,0 +1,104 @@
+package dura
+
+import (
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// discoverRepos walks the watched directory root and returns the working directory of
+// every git repository found within it, root included. Directories deeper than the watch
+// configuration's max depth are not visited, excluded directories are skipped and a
+// repository's working directory is never searched for further nested repositories.
+func discoverRepos(root string, wc WatchConfig) (repos []string, err error) {
+	log.Trace().Msg("entered discoverRepos")
+	repos, err = discover(root, wc, nil)
+	log.Trace().Msg("leaving discoverRepos")
+	return
+}
+
+// discover implements discoverRepos, if dirs is non-nil every directory visited which
+// isn't part of a repository (root included) is appended to it.
+func discover(root string, wc WatchConfig, dirs *[]string) (repos []string, err error) {
+	log.Trace().Msg("entered discover")
+	logger := log.With().Str("root", root).Logger()
+	var fileInfo os.FileInfo
+	logger.Trace().Msgf("retrieve file information for path %s", root)
+	if fileInfo, err = os.Stat(root); err != nil {
+		logger.Error().Err(err).Msgf("error encountered attempting to retrieve file information for path %s", root)
+		return
+	}
+	if !fileInfo.IsDir() {
+		logger.Warn().Msgf("watched path %s is not a directory, nothing to discover", root)
+		return
+	}
+	discoverDir(root, "", newWatchFilter(wc, ""), &repos, dirs)
+	logger.Debug().Strs("repos", repos).Msgf("discovered %d repositories", len(repos))
+	log.Trace().Msg("leaving discover")
+	return
+}
+
+// discoverDir looks for repositories in the directory rel (relative to root), appending
+// any found to repos and, if dirs is non-nil, any other directory visited to dirs.
+// Unreadable directories are logged and skipped.
+func discoverDir(root string, rel string, filter *watchFilter, repos *[]string, dirs *[]string) {
+	dir := filepath.Join(root, filepath.FromSlash(rel))
+	if isWorktree(dir) {
+		if rel == "" || !filter.excluded(rel+"/") {
+			log.Trace().Str("repo", dir).Msg("found repository")
+			*repos = append(*repos, dir)
+		}
+		return
+	}
+	if dirs != nil {
+		*dirs = append(*dirs, dir)
+	}
+	depth := 0
+	if rel != "" {
+		depth = strings.Count(rel, "/") + 1
+	}
+	if depth >= filter.maxDepth {
+		log.Trace().Str("dir", dir).Int("depth", depth).Msg("max depth reached, not descending further")
+		return
+	}
+	var (
+		entries []os.FileInfo
+		err     error
+	)
+	if entries, err = ioutil.ReadDir(dir); err != nil {
+		log.Warn().Err(err).Str("dir", dir).Msg("unable to read directory while discovering repositories, skipping")
+		return
+	}
+	for _, entry := range entries {
+		// Symbolic links are not followed, ReadDir reports them as non-directories
+		if !entry.IsDir() || entry.Name() == ".git" {
+			continue
+		}
+		childRel := path.Join(rel, entry.Name())
+		if filter.excluded(childRel + "/") {
+			log.Trace().Str("dir", childRel).Msg("directory excluded by watch configuration, skipping")
+			continue
+		}
+		discoverDir(root, childRel, filter, repos, dirs)
+	}
+}
+
+// isWorktree reports whether dir is the working directory of a git repository, that
+// is whether it contains a .git directory (or file, for linked worktrees and submodules).
+func isWorktree(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// watchRelPath returns repo relative to the watched directory root using forward
+// slashes, or an empty string if repo is root itself.
+func watchRelPath(root string, repo string) (rel string) {
+	var err error
+	if rel, err = filepath.Rel(root, repo); err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
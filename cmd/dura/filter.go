@@ -0,0 +1,89 @@
+package dura
+
+import (
+	"github.com/rs/zerolog/log"
+	ignore "github.com/sabhiram/go-gitignore"
+	"path"
+	"strings"
+)
+
+// watchFilter is the compiled form of a WatchConfig's include, exclude and max depth
+// settings. Patterns and depth are relative to the watched directory, while paths handed
+// to the filter are relative to the repository root and use forward slashes, as reported
+// by libgit2. The prefix is the repository's location below the watched directory and is
+// empty when the watched directory is the repository itself.
+type watchFilter struct {
+	include  *ignore.GitIgnore
+	exclude  *ignore.GitIgnore
+	maxDepth int
+	prefix   string
+	// wc is the watch configuration the filter was compiled from, captures consult it
+	// for the repository's commit settings
+	wc WatchConfig
+}
+
+func newWatchFilter(wc WatchConfig, prefix string) (filter *watchFilter) {
+	log.Trace().Msg("entered newWatchFilter")
+	filter = &watchFilter{
+		maxDepth: wc.MaxDepth,
+		prefix:   strings.Trim(prefix, "/"),
+		wc:       wc,
+	}
+	if len(wc.Include) > 0 {
+		filter.include = ignore.CompileIgnoreLines(wc.Include...)
+		log.Debug().Strs("include", wc.Include).Msg("compiled include patterns")
+	}
+	if len(wc.Exclude) > 0 {
+		filter.exclude = ignore.CompileIgnoreLines(wc.Exclude...)
+		log.Debug().Strs("exclude", wc.Exclude).Msg("compiled exclude patterns")
+	}
+	if filter.maxDepth <= 0 || filter.maxDepth > DefMaxDepth {
+		log.Debug().Int("maxDepth", filter.maxDepth).Int("default", DefMaxDepth).Msg("max depth unset or out of range, using default")
+		filter.maxDepth = DefMaxDepth
+	}
+	log.Trace().Msg("leaving newWatchFilter")
+	return
+}
+
+// rooted returns p relative to the watched directory.
+func (f *watchFilter) rooted(p string) string {
+	if f.prefix == "" {
+		return p
+	}
+	return path.Join(f.prefix, p)
+}
+
+// hasInclude reports whether the filter forces in any paths, in which case ignored
+// files must be considered as well.
+func (f *watchFilter) hasInclude() bool {
+	return f.include != nil
+}
+
+// included reports whether p matches one of the include patterns.
+func (f *watchFilter) included(p string) bool {
+	return f.include != nil && f.include.MatchesPath(f.rooted(p))
+}
+
+// excluded reports whether p matches one of the exclude patterns.
+func (f *watchFilter) excluded(p string) bool {
+	return f.exclude != nil && f.exclude.MatchesPath(f.rooted(p))
+}
+
+// tooDeep reports whether the directory containing p lies deeper below the watched
+// directory than allowed.
+func (f *watchFilter) tooDeep(p string) bool {
+	return strings.Count(strings.Trim(f.rooted(p), "/"), "/") > f.maxDepth
+}
+
+// allows reports whether a change to p should be part of a snapshot. Paths that would
+// otherwise be ignored (by .gitignore) or too deep are only allowed when they are
+// explicitly included. Exclude patterns always win.
+func (f *watchFilter) allows(p string, ignored bool) bool {
+	if f.excluded(p) {
+		return false
+	}
+	if f.included(p) {
+		return true
+	}
+	return !ignored && !f.tooDeep(p)
+}
@@ -0,0 +1,520 @@
+package dura
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ArchiveRefNamespace is where dura gc --archive moves collected Dura refs, outside of
+	// the namespaces Dura reads snapshots from
+	ArchiveRefNamespace = "refs/dura-archive"
+)
+
+// specialHeads are the files beside HEAD which may hold the only reference to a commit
+var specialHeads = []string{"ORIG_HEAD", "FETCH_HEAD", "MERGE_HEAD", "CHERRY_PICK_HEAD", "REVERT_HEAD"}
+
+// GCOptions configures GC, zero values fall back to the gc configuration section.
+type GCOptions struct {
+	// Branches are the branches (or any revisions) whose history is searched for the
+	// trees of the Dura refs
+	Branches []string
+	// Archive moves the collected refs to ArchiveRefNamespace instead of deleting them
+	Archive bool
+	// DryRun only reports the refs which would be collected
+	DryRun bool
+	// PruneObjects removes the unreachable loose objects older than PruneExpire afterwards
+	PruneObjects bool
+	PruneExpire  time.Duration
+}
+
+// CollectedRef is a Dura ref collected by GC.
+type CollectedRef struct {
+	Ref string `json:"ref"`
+	// Tip is the commit the ref pointed to
+	Tip string `json:"tip"`
+	// Commit is the commit of the searched branches with the same tree as Tip
+	Commit string `json:"commit"`
+	// Archive is the name the ref was archived as, empty if it was deleted
+	Archive string `json:"archive,omitempty"`
+}
+
+// GCResult is the outcome of GC for a repository.
+type GCResult struct {
+	Repo      string         `json:"repo"`
+	Collected []CollectedRef `json:"collected"`
+	// Protected are the fully committed Dura refs kept because they hold a tagged snapshot
+	Protected     []string `json:"protected,omitempty"`
+	PrunedObjects int      `json:"pruned_objects"`
+	PrunedBytes   int64    `json:"pruned_bytes"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// GC collects the Dura refs of the repository at path whose newest snapshot is fully
+// committed: its tree is the tree of a commit reachable from one of the branches of
+// opts. Their work is in the real history, so they are deleted, or archived under
+// ArchiveRefNamespace. Refs holding a snapshot tagged with CreateTag are never
+// collected. With opts.PruneObjects, the loose objects which are no longer
+// reachable from any ref, reflog, HEAD or the index and are older than
+// opts.PruneExpire are then removed.
+func GC(path string, opts GCOptions) (result *GCResult, err error) {
+	log.Trace().Msg("entered GC")
+	logger := log.With().Str("path", path).Logger()
+	var (
+		repo  *git.Repository
+		store *git.Repository
+	)
+	if repo, err = OpenRepository(path); err != nil {
+		return
+	}
+	if store, err = duraStore(repo); err != nil {
+		return
+	}
+	result = &GCResult{Repo: path}
+	settings := currentConfig()
+	branches := opts.Branches
+	if len(branches) == 0 {
+		if branches = settings.GC.Branches; len(branches) == 0 {
+			branches = DefGCBranches
+		}
+	}
+	if result.Collected, result.Protected, err = committedRefs(repo, branches); err != nil {
+		return
+	}
+	logger.Debug().Int("refs", len(result.Collected)).Strs("branches", branches).Msg("found fully committed Dura refs")
+	if !opts.DryRun {
+		archive := opts.Archive || settings.GC.Archive
+		for i := range result.Collected {
+			if err = collectRef(store, &result.Collected[i], archive); err != nil {
+				logger.Error().Err(err).Str("ref", result.Collected[i].Ref).Msg("error encountered while collecting Dura ref")
+				return
+			}
+		}
+	}
+	if opts.PruneObjects {
+		expire := opts.PruneExpire
+		if expire <= 0 {
+			expire = time.Duration(settings.GC.PruneExpireDays) * 24 * time.Hour
+		}
+		// A shadowed repository never receives Dura objects, those of its shadow are pruned
+		var own *git.Odb
+		if store != repo {
+			if own, err = shadowObjects(store); err != nil {
+				return
+			}
+		}
+		if result.PrunedObjects, result.PrunedBytes, err = pruneLooseObjects(store, own, time.Now().Add(-expire), opts.DryRun); err != nil {
+			logger.Error().Err(err).Msg("error encountered while pruning loose objects")
+			return
+		}
+	}
+	logger.Info().Int("collected", len(result.Collected)).Int("prunedObjects", result.PrunedObjects).Bool("dryRun", opts.DryRun).Msg("garbage collection complete")
+	log.Trace().Msg("leaving GC")
+	return
+}
+
+// GCAll runs GC on every repository watched, a repository which fails is reported in
+// its result and doesn't stop the others.
+func GCAll(opts GCOptions) (results []GCResult) {
+	log.Trace().Msg("entered GCAll")
+	for root, wc := range currentConfig().GitRepos() {
+		repos, err := discoverRepos(root, wc)
+		if err != nil {
+			log.Error().Err(err).Msgf("error encountered while discovering repositories in '%s', will continue", root)
+			results = append(results, GCResult{Repo: root, Error: err.Error()})
+			continue
+		}
+		for _, repo := range repos {
+			result, err := GC(repo, opts)
+			if result == nil {
+				result = &GCResult{Repo: repo}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, *result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Repo < results[j].Repo })
+	log.Trace().Msg("leaving GCAll")
+	return
+}
+
+// committedRefs returns the Dura refs of repo whose tip tree is the tree of a commit
+// reachable from branches, branches which don't exist are skipped. Refs holding a tagged
+// snapshot are returned as protected instead.
+func committedRefs(repo *git.Repository, branches []string) (collected []CollectedRef, protected []string, err error) {
+	log.Trace().Msg("entered committedRefs")
+	var (
+		refs   []string
+		tagged map[string]bool
+		walk   *git.RevWalk
+		// wanted maps the tip trees of the Dura refs to the refs
+		wanted = map[string][]CollectedRef{}
+		pushed int
+	)
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	if tagged, err = taggedSnapshots(repo); err != nil {
+		return
+	}
+	for _, ref := range refs {
+		var tip *git.Commit
+		if tip, err = lookupRefCommit(repo, ref); err != nil {
+			return
+		}
+		if tip != nil {
+			tree := tip.TreeId().String()
+			wanted[tree] = append(wanted[tree], CollectedRef{Ref: ref, Tip: tip.Id().String()})
+		}
+	}
+	if len(wanted) == 0 {
+		return
+	}
+	if walk, err = repo.Walk(); err != nil {
+		return
+	}
+	defer walk.Free()
+	for _, branch := range branches {
+		var obj *git.Object
+		if obj, err = repo.RevparseSingle(branch); err == nil {
+			if obj, err = obj.Peel(git.ObjectCommit); err == nil {
+				err = walk.Push(obj.Id())
+			}
+		}
+		if err != nil {
+			log.Debug().Err(err).Str("branch", branch).Msg("branch not found, skipping")
+			err = nil
+			continue
+		}
+		pushed++
+	}
+	if pushed == 0 {
+		err = fmt.Errorf("none of the branches %s exist", strings.Join(branches, ", "))
+		return
+	}
+	walk.Sorting(git.SortTime)
+	err = walk.Iterate(func(commit *git.Commit) bool {
+		tree := commit.TreeId().String()
+		for _, ref := range wanted[tree] {
+			ref.Commit = commit.Id().String()
+			collected = append(collected, ref)
+		}
+		delete(wanted, tree)
+		return len(wanted) > 0
+	})
+	if err != nil {
+		return
+	}
+	if len(tagged) > 0 {
+		unprotected := collected[:0]
+		for _, ref := range collected {
+			var holder bool
+			if holder, err = holdsTagged(repo, ref.Ref, tagged); err != nil {
+				return
+			}
+			if holder {
+				log.Debug().Str("ref", ref.Ref).Msg("Dura ref holds a tagged snapshot, keeping it")
+				protected = append(protected, ref.Ref)
+			} else {
+				unprotected = append(unprotected, ref)
+			}
+		}
+		collected = unprotected
+	}
+	sort.Slice(collected, func(i, j int) bool { return collected[i].Ref < collected[j].Ref })
+	log.Trace().Msg("leaving committedRefs")
+	return
+}
+
+// holdsTagged returns true if one of the snapshots of the Dura ref is in tagged.
+func holdsTagged(repo *git.Repository, ref string, tagged map[string]bool) (holder bool, err error) {
+	err = walkRef(repo, ref, refBase(ref), func(commit *git.Commit) error {
+		holder = holder || tagged[commit.Id().String()]
+		return nil
+	})
+	return
+}
+
+// collectRef deletes the Dura ref of c, after creating its archive ref when archive is
+// true. A ref which no longer points to c.Tip (a snapshot was taken meanwhile) is left.
+func collectRef(repo *git.Repository, c *CollectedRef, archive bool) (err error) {
+	var (
+		ref *git.Reference
+		oid *git.Oid
+	)
+	if ref, err = repo.References.Lookup(c.Ref); err != nil {
+		return
+	}
+	if ref.Target() == nil || ref.Target().String() != c.Tip {
+		log.Warn().Str("ref", c.Ref).Msg("ref changed during garbage collection, leaving it in place")
+		return
+	}
+	if archive {
+		name := fmt.Sprintf("%s/%s", ArchiveRefNamespace, strings.TrimPrefix(c.Ref, "refs/"))
+		if oid, err = git.NewOid(c.Tip); err != nil {
+			return
+		}
+		if _, err = repo.References.Create(name, oid, true, fmt.Sprintf("dura gc: archived %s", c.Ref)); err != nil {
+			return
+		}
+		c.Archive = name
+	}
+	return ref.Delete()
+}
+
+// pruneLooseObjects removes the loose objects of repo modified before expire which are
+// unreachable, returning their number and size. Packed objects are left to git gc. own
+// holds the objects of a shadow repository itself (nil for other repositories).
+func pruneLooseObjects(repo *git.Repository, own *git.Odb, expire time.Time, dryRun bool) (count int, size int64, err error) {
+	log.Trace().Msg("entered pruneLooseObjects")
+	logger := log.With().Str("repo", repo.Path()).Logger()
+	if _, statErr := os.Stat(filepath.Join(repo.Path(), "worktrees")); statErr == nil {
+		err = errors.New("repository has linked worktrees, whose HEAD and index aren't considered, not pruning objects")
+		return
+	}
+	candidates := map[string]os.FileInfo{}
+	objects := filepath.Join(repo.Path(), "objects")
+	var dirs []os.FileInfo
+	if dirs, err = readDir(objects); err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 || strings.Trim(dir.Name(), "0123456789abcdef") != "" {
+			continue
+		}
+		var files []os.FileInfo
+		if files, err = readDir(filepath.Join(objects, dir.Name())); err != nil {
+			return
+		}
+		for _, file := range files {
+			if hash := dir.Name() + file.Name(); shaRe.MatchString(hash) && file.ModTime().Before(expire) {
+				candidates[hash] = file
+			}
+		}
+	}
+	logger.Debug().Int("candidates", len(candidates)).Time("expire", expire).Msg("found expired loose objects")
+	if len(candidates) == 0 {
+		return
+	}
+	var reachable map[string]bool
+	if reachable, err = reachableObjects(repo, own); err != nil {
+		return
+	}
+	for hash, file := range candidates {
+		if reachable[hash] {
+			continue
+		}
+		if !dryRun {
+			if err = os.Remove(filepath.Join(objects, hash[:2], hash[2:])); err != nil {
+				return
+			}
+		}
+		count++
+		size += file.Size()
+	}
+	logger.Debug().Int("pruned", count).Int64("bytes", size).Bool("dryRun", dryRun).Msg("pruned unreachable loose objects")
+	log.Trace().Msg("leaving pruneLooseObjects")
+	return
+}
+
+// reachableObjects returns the hashes of every object of repo reachable from its refs,
+// their reflogs, HEAD and the other special heads, and the index. For a shadow
+// repository, own holds its objects: the history is only followed through the commits
+// it holds, as it keeps the base commits of its snapshots but not their ancestors,
+// which the working repository may have dropped.
+func reachableObjects(repo *git.Repository, own *git.Odb) (reachable map[string]bool, err error) {
+	log.Trace().Msg("entered reachableObjects")
+	var (
+		walk    *git.RevWalk
+		iter    *git.ReferenceIterator
+		ref     *git.Reference
+		pending []*git.Oid
+	)
+	reachable = map[string]bool{}
+	if walk, err = repo.Walk(); err != nil {
+		return
+	}
+	defer walk.Free()
+	var markTree func(id *git.Oid)
+	markTree = func(id *git.Oid) {
+		if reachable[id.String()] {
+			return
+		}
+		reachable[id.String()] = true
+		tree, lookupErr := repo.LookupTree(id)
+		if lookupErr != nil {
+			return
+		}
+		for i := uint64(0); i < tree.EntryCount(); i++ {
+			switch entry := tree.EntryByIndex(i); entry.Type {
+			case git.ObjectTree:
+				markTree(entry.Id)
+			case git.ObjectBlob:
+				reachable[entry.Id.String()] = true
+			}
+		}
+	}
+	pushCommit := func(id *git.Oid) {
+		if own == nil {
+			_ = walk.Push(id)
+		} else if own.Exists(id) {
+			pending = append(pending, id)
+		}
+	}
+	// mark records id and what it points to, commits are left to the revision walk
+	var mark func(id *git.Oid)
+	mark = func(id *git.Oid) {
+		obj, lookupErr := repo.Lookup(id)
+		if lookupErr != nil {
+			return
+		}
+		switch obj.Type() {
+		case git.ObjectCommit:
+			pushCommit(id)
+		case git.ObjectTag:
+			reachable[id.String()] = true
+			if tag, tagErr := obj.AsTag(); tagErr == nil {
+				mark(tag.TargetId())
+			}
+		case git.ObjectTree:
+			markTree(id)
+		default:
+			reachable[id.String()] = true
+		}
+	}
+
+	if iter, err = repo.NewReferenceIterator(); err != nil {
+		return
+	}
+	for {
+		if ref, err = iter.Next(); err != nil {
+			if git.IsErrorCode(err, git.ErrorCodeIterOver) {
+				err = nil
+				break
+			}
+			iter.Free()
+			return
+		}
+		if ref.Type() == git.ReferenceOid {
+			mark(ref.Target())
+		}
+	}
+	iter.Free()
+	if head, headErr := repo.Head(); headErr == nil && head.Target() != nil {
+		mark(head.Target())
+	}
+	var ids []*git.Oid
+	if ids, err = loggedIds(repo); err != nil {
+		return
+	}
+	for _, id := range ids {
+		mark(id)
+	}
+	if index, indexErr := repo.Index(); indexErr == nil {
+		for i := uint(0); i < index.EntryCount(); i++ {
+			if entry, entryErr := index.EntryByIndex(i); entryErr == nil {
+				reachable[entry.Id.String()] = true
+			}
+		}
+		index.Free()
+	}
+	if own == nil {
+		if err = walk.Iterate(func(commit *git.Commit) bool {
+			reachable[commit.Id().String()] = true
+			markTree(commit.TreeId())
+			return true
+		}); err != nil {
+			return
+		}
+	}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[id.String()] {
+			continue
+		}
+		reachable[id.String()] = true
+		commit, lookupErr := repo.LookupCommit(id)
+		if lookupErr != nil {
+			continue
+		}
+		markTree(commit.TreeId())
+		for i := uint(0); i < commit.ParentCount(); i++ {
+			pushCommit(commit.ParentId(i))
+		}
+	}
+	log.Debug().Int("objects", len(reachable)).Msg("reachable objects marked")
+	log.Trace().Msg("leaving reachableObjects")
+	return
+}
+
+// loggedIds returns the object ids recorded in the reflogs of repo and in its special
+// heads, which git2go offers no API for.
+func loggedIds(repo *git.Repository) (ids []*git.Oid, err error) {
+	add := func(s string) {
+		if shaRe.MatchString(s) {
+			if id, oidErr := git.NewOid(s); oidErr == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	readLines := func(path string, fn func(fields []string)) error {
+		file, openErr := os.Open(path)
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fn(strings.Fields(scanner.Text()))
+		}
+		return scanner.Err()
+	}
+	for _, name := range specialHeads {
+		if readErr := readLines(filepath.Join(repo.Path(), name), func(fields []string) {
+			if len(fields) > 0 {
+				add(fields[0])
+			}
+		}); readErr != nil && !os.IsNotExist(readErr) {
+			return nil, readErr
+		}
+	}
+	logs := filepath.Join(repo.Path(), "logs")
+	err = filepath.Walk(logs, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) {
+				return nil
+			}
+			return walkErr
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return readLines(path, func(fields []string) {
+			if len(fields) > 1 {
+				add(fields[0])
+				add(fields[1])
+			}
+		})
+	})
+	return
+}
+
+// readDir lists dir, a missing directory has no entries.
+func readDir(dir string) (entries []os.FileInfo, err error) {
+	if entries, err = ioutil.ReadDir(dir); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,391 @@
+package dura
+
+import (
+	"errors"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is a single Dura commit along with a summary of the changes it captured
+// relative to the previous snapshot (or the base commit, for the first snapshot).
+type Snapshot struct {
+	Hash       string    `json:"hash"`
+	Ref        string    `json:"ref"`
+	Base       string    `json:"base"`
+	Time       time.Time `json:"time"`
+	Message    string    `json:"message"`
+	Files      []string  `json:"files"`
+	Insertions int       `json:"insertions"`
+	Deletions  int       `json:"deletions"`
+	// Previous is the hash of the snapshot this one continues from after HEAD moved,
+	// recorded as its second parent in lineage mode
+	Previous string `json:"previous,omitempty"`
+}
+
+// SnapshotGroup holds the snapshots taken on top of a single base commit, newest first.
+type SnapshotGroup struct {
+	Base        string     `json:"base"`
+	BaseSummary string     `json:"base_summary"`
+	Refs        []string   `json:"refs"`
+	Snapshots   []Snapshot `json:"snapshots"`
+}
+
+// LogOptions narrows down the snapshots returned by Snapshots, zero values match all.
+type LogOptions struct {
+	Since time.Time
+	Until time.Time
+	// File is a path relative to the repository root, snapshots are only returned if they
+	// changed it (or, for a directory, anything beneath it)
+	File string
+	// Base is a (possibly abbreviated) base commit hash
+	Base string
+	// Lineage only returns the snapshots the newest snapshot descends from, following
+	// the links recorded across HEAD moves in lineage mode
+	Lineage bool
+}
+
+func (o *LogOptions) matches(s *Snapshot) bool {
+	if !o.Since.IsZero() && s.Time.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && s.Time.After(o.Until) {
+		return false
+	}
+	if o.File == "" {
+		return true
+	}
+	for _, file := range s.Files {
+		if file == o.File || strings.HasPrefix(file, o.File+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenRepository opens the repository containing path, which may be its working
+// directory or any directory below it.
+func OpenRepository(path string) (repo *git.Repository, err error) {
+	log.Trace().Msg("entered OpenRepository")
+	if repo, err = git.OpenRepositoryExtended(path, 0, ""); err != nil {
+		log.Error().Err(err).Str("path", path).Msgf("error encountered while attempting to open git repository containing '%s'", path)
+		return
+	}
+	if err = attachShadow(repo); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("error encountered while attaching shadow repository")
+		return
+	}
+	log.Trace().Msg("leaving OpenRepository")
+	return
+}
+
+// RepoRelPath returns p (relative to the current directory unless absolute) relative to
+// the working directory of repo using forward slashes, as used in git trees.
+func RepoRelPath(repo *git.Repository, p string) (rel string, err error) {
+	var abs string
+	if abs, err = filepath.Abs(p); err != nil {
+		return
+	}
+	workdir := repo.Workdir()
+	if workdir == "" {
+		err = errors.New("repository has no working directory")
+		return
+	}
+	if resolved, evalErr := filepath.EvalSymlinks(filepath.Dir(abs)); evalErr == nil {
+		abs = filepath.Join(resolved, filepath.Base(abs))
+	}
+	if resolved, evalErr := filepath.EvalSymlinks(workdir); evalErr == nil {
+		workdir = resolved
+	}
+	if rel, err = filepath.Rel(workdir, abs); err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		err = fmt.Errorf("%s is outside of repository %s", p, repo.Workdir())
+		return
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return
+}
+
+// Snapshots returns the snapshots of every Dura ref of repo which match opts, grouped by
+// base commit. Groups are ordered by their newest snapshot, newest first.
+func Snapshots(repo *git.Repository, opts LogOptions) (groups []SnapshotGroup, err error) {
+	log.Trace().Msg("entered Snapshots")
+	logger := log.With().Str("repo", repo.Path()).Logger()
+	var refs []string
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	logger.Debug().Int("refs", len(refs)).Msg("found Dura refs")
+	var (
+		byBase = map[string]*SnapshotGroup{}
+		// older maps each snapshot to the one before it on the same ref
+		older  = map[string]string{}
+		newest *Snapshot
+	)
+	for _, ref := range refs {
+		base := refBase(ref)
+		if opts.Base != "" && !opts.Lineage && !strings.HasPrefix(base, opts.Base) {
+			continue
+		}
+		var snapshots []Snapshot
+		if snapshots, err = refSnapshots(repo, ref, base); err != nil {
+			logger.Error().Err(err).Str("ref", ref).Msg("error encountered while reading Dura ref, will continue")
+			err = nil
+			continue
+		}
+		group, ok := byBase[base]
+		if !ok {
+			group = &SnapshotGroup{Base: base}
+			if base == "" {
+				group.BaseSummary = "(no commits yet)"
+			} else if oid, oidErr := git.NewOid(base); oidErr == nil {
+				if commit, lookupErr := repo.LookupCommit(oid); lookupErr == nil {
+					group.BaseSummary = commit.Summary()
+				}
+			}
+			byBase[base] = group
+		}
+		group.Refs = append(group.Refs, ref)
+		for i := range snapshots {
+			if i+1 < len(snapshots) {
+				older[snapshots[i].Hash] = snapshots[i+1].Hash
+			}
+			if newest == nil || snapshots[i].Time.After(newest.Time) {
+				newest = &snapshots[i]
+			}
+		}
+		group.Snapshots = append(group.Snapshots, snapshots...)
+	}
+	var lineage map[string]bool
+	if opts.Lineage && newest != nil {
+		lineage = snapshotLineage(newest.Hash, older, byBase)
+		logger.Debug().Int("snapshots", len(lineage)).Str("newest", newest.Hash).Msg("followed snapshot lineage")
+	}
+	for base, group := range byBase {
+		if opts.Base != "" && !strings.HasPrefix(base, opts.Base) {
+			continue
+		}
+		var snapshots []Snapshot
+		for i := range group.Snapshots {
+			if opts.matches(&group.Snapshots[i]) && (lineage == nil || lineage[group.Snapshots[i].Hash]) {
+				snapshots = append(snapshots, group.Snapshots[i])
+			}
+		}
+		if group.Snapshots = snapshots; len(group.Snapshots) == 0 {
+			continue
+		}
+		sort.SliceStable(group.Snapshots, func(i, j int) bool {
+			return group.Snapshots[i].Time.After(group.Snapshots[j].Time)
+		})
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		ti, tj := groups[i].Snapshots[0].Time, groups[j].Snapshots[0].Time
+		if ti.Equal(tj) {
+			return groups[i].Base < groups[j].Base
+		}
+		return ti.After(tj)
+	})
+	log.Trace().Msg("leaving Snapshots")
+	return
+}
+
+// snapshotLineage returns the hashes of the snapshots start descends from: those before
+// it on its ref and, through the snapshots recorded as Previous, on the refs it continues.
+func snapshotLineage(start string, older map[string]string, byBase map[string]*SnapshotGroup) (lineage map[string]bool) {
+	previous := map[string]string{}
+	for _, group := range byBase {
+		for _, snapshot := range group.Snapshots {
+			if snapshot.Previous != "" {
+				previous[snapshot.Hash] = snapshot.Previous
+			}
+		}
+	}
+	lineage = map[string]bool{}
+	pending := []string{start}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if hash == "" || lineage[hash] {
+			continue
+		}
+		lineage[hash] = true
+		pending = append(pending, older[hash], previous[hash])
+	}
+	return
+}
+
+// refSnapshots walks the first parents of ref until its base commit, returning the
+// snapshots in the order visited (newest first).
+func refSnapshots(repo *git.Repository, ref string, base string) (snapshots []Snapshot, err error) {
+	err = walkRef(repo, ref, base, func(commit *git.Commit) (err error) {
+		var snapshot *Snapshot
+		if snapshot, err = newSnapshot(repo, commit); err != nil {
+			return
+		}
+		snapshot.Ref = ref
+		snapshot.Base = base
+		snapshots = append(snapshots, *snapshot)
+		return
+	})
+	return
+}
+
+// walkRef calls fn for every snapshot commit of ref, following first parents from the
+// commit ref points to until its base commit. An error returned by fn stops the walk.
+func walkRef(repo *git.Repository, ref string, base string, fn func(commit *git.Commit) error) (err error) {
+	var commit *git.Commit
+	if commit, err = lookupRefCommit(repo, ref); err != nil {
+		return
+	}
+	for commit != nil && commit.Id().String() != base {
+		if err = fn(commit); err != nil {
+			return
+		}
+		if commit.ParentCount() == 0 {
+			break
+		}
+		commit = commit.Parent(0)
+	}
+	return
+}
+
+// walkSnapshots calls fn for every snapshot commit on every Dura ref of repo matched by
+// match (all if nil), a ref which can't be read is logged and skipped.
+func walkSnapshots(repo *git.Repository, match func(ref string) bool, fn func(ref string, commit *git.Commit) error) (err error) {
+	log.Trace().Msg("entered walkSnapshots")
+	var refs []string
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	for _, ref := range refs {
+		if match != nil && !match(ref) {
+			continue
+		}
+		var fnErr error
+		r := ref
+		if err = walkRef(repo, r, refBase(r), func(commit *git.Commit) error {
+			fnErr = fn(r, commit)
+			return fnErr
+		}); err != nil {
+			if fnErr != nil {
+				return
+			}
+			log.Error().Err(err).Str("ref", r).Msg("error encountered while reading Dura ref, will continue")
+			err = nil
+		}
+	}
+	log.Trace().Msg("leaving walkSnapshots")
+	return
+}
+
+// LatestSnapshot returns the newest snapshot commit across every Dura ref of repo
+// taken at or before t, an error is returned if there is none.
+func LatestSnapshot(repo *git.Repository, t time.Time) (latest *git.Commit, err error) {
+	return latestSnapshot(repo, t, nil)
+}
+
+// latestSnapshot implements LatestSnapshot, only considering the Dura refs matched by
+// match (all if nil).
+func latestSnapshot(repo *git.Repository, t time.Time, match func(ref string) bool) (latest *git.Commit, err error) {
+	log.Trace().Msg("entered latestSnapshot")
+	err = walkSnapshots(repo, match, func(ref string, commit *git.Commit) error {
+		when := commit.Committer().When
+		if when.After(t) {
+			return nil
+		}
+		if latest == nil || when.After(latest.Committer().When) {
+			latest = commit
+		}
+		return nil
+	})
+	if err == nil && latest == nil {
+		err = fmt.Errorf("no snapshot found at or before %s", t.Format(time.RFC3339))
+	}
+	log.Trace().Msg("leaving latestSnapshot")
+	return
+}
+
+// latestTip returns the newest commit pointed to by a Dura ref of repo other than
+// exclude, nil if there is none.
+func latestTip(repo *git.Repository, exclude string) (latest *git.Commit, err error) {
+	log.Trace().Msg("entered latestTip")
+	var refs []string
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	for _, ref := range refs {
+		if ref == exclude {
+			continue
+		}
+		var commit *git.Commit
+		if commit, err = lookupRefCommit(repo, ref); err != nil {
+			return
+		}
+		if commit != nil && (latest == nil || commit.Committer().When.After(latest.Committer().When)) {
+			latest = commit
+		}
+	}
+	log.Trace().Msg("leaving latestTip")
+	return
+}
+
+// newSnapshot summarizes commit by diffing it against its first parent.
+func newSnapshot(repo *git.Repository, commit *git.Commit) (snapshot *Snapshot, err error) {
+	var (
+		tree, parentTree *git.Tree
+		diff             *git.Diff
+		stats            *git.DiffStats
+		deltas           int
+	)
+	if tree, err = commit.Tree(); err != nil {
+		return
+	}
+	if commit.ParentCount() > 0 {
+		if parentTree, err = commit.Parent(0).Tree(); err != nil {
+			return
+		}
+	}
+	if diff, err = repo.DiffTreeToTree(parentTree, tree, nil); err != nil {
+		return
+	}
+	defer diff.Free()
+	snapshot = &Snapshot{
+		Hash:    commit.Id().String(),
+		Time:    commit.Committer().When,
+		Message: commit.Message(),
+	}
+	if commit.ParentCount() > 1 {
+		snapshot.Previous = commit.ParentId(1).String()
+	}
+	if deltas, err = diff.NumDeltas(); err != nil {
+		return
+	}
+	for i := 0; i < deltas; i++ {
+		var delta git.DiffDelta
+		if delta, err = diff.Delta(i); err != nil {
+			return
+		}
+		file := delta.NewFile.Path
+		if delta.Status == git.DeltaDeleted {
+			file = delta.OldFile.Path
+		}
+		snapshot.Files = append(snapshot.Files, file)
+	}
+	if stats, err = diff.Stats(); err != nil {
+		return
+	}
+	defer stats.Free()
+	snapshot.Insertions = stats.Insertions()
+	snapshot.Deletions = stats.Deletions()
+	return
+}
@@ -0,0 +1,193 @@
+package dura
+
+import (
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// snapshotIndex builds a private, in-memory index holding the current state of the
+// repository's working tree. The index is seeded from the head commit's tree and every
+// working tree change relative to that tree is then applied on top of it, meaning the
+// user's real index (.git/index) and anything staged in it is never modified. Only
+// changes allowed by filter are applied, everything else keeps its head commit version.
+// A nil head (an unborn branch) seeds the index with nothing.
+func snapshotIndex(repo *git.Repository, head *git.Commit, filter *watchFilter) (index *git.Index, err error) {
+	log.Trace().Msg("entered snapshotIndex")
+	logger := log.With().Str("repo", repo.Path()).Logger()
+	var (
+		headTree *git.Tree
+		diff     *git.Diff
+		diffOpts git.DiffOptions
+		deltas   int
+		delta    git.DiffDelta
+	)
+	logger.Trace().Msg("creating in-memory index")
+	if index, err = git.NewIndex(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while creating in-memory index")
+		return
+	}
+	if head != nil {
+		logger.Trace().Msg("retrieve tree of repository head commit")
+		if headTree, err = head.Tree(); err != nil {
+			logger.Error().Err(err).Msg("error encountered while retrieving tree of the repository head commit")
+			index.Free()
+			return
+		}
+		logger.Trace().Str("tree", headTree.Id().String()).Msg("seeding in-memory index from head commit tree")
+		if err = index.ReadTree(headTree); err != nil {
+			logger.Error().Err(err).Str("tree", headTree.Id().String()).Msg("error encountered while reading head commit tree into in-memory index")
+			index.Free()
+			return
+		}
+		logger.Debug().Uint("entries", index.EntryCount()).Msg("in-memory index seeded from head commit tree")
+	} else {
+		logger.Debug().Msg("no head commit, in-memory index starts out empty")
+	}
+
+	logger.Trace().Msg("setting diff options")
+	if diffOpts, err = git.DefaultDiffOptions(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while attempting to set diff options")
+		index.Free()
+		return
+	}
+	diffOpts.Flags = git.DiffIncludeUntracked | git.DiffRecurseUntracked | git.DiffIncludeTypeChange
+	diffOpts.IgnoreSubmodules = git.SubmoduleIgnoreAll
+	if filter.hasInclude() {
+		logger.Trace().Msg("include patterns present, adding ignored files to diff")
+		diffOpts.Flags |= git.DiffIncludeIgnored | git.DiffRecurseIgnoredDirs
+	}
+	logger.Trace().Msg("calling repo.DiffTreeToWorkdirWithIndex")
+	if diff, err = repo.DiffTreeToWorkdirWithIndex(headTree, &diffOpts); err != nil {
+		logger.Error().Err(err).Msg("error encountered while getting diff of head tree-to-workdir")
+		index.Free()
+		return
+	}
+	defer diff.Free()
+	if deltas, err = diff.NumDeltas(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while retrieving deltas")
+		index.Free()
+		return
+	}
+	logger.Debug().Int("deltas", deltas).Msg("working tree deltas found")
+
+	for i := 0; i < deltas; i++ {
+		if delta, err = diff.Delta(i); err != nil {
+			logger.Error().Err(err).Int("delta", i).Msg("error encountered while retrieving delta")
+			index.Free()
+			return
+		}
+		if filePath := delta.NewFile.Path; !filter.allows(filePath, delta.Status == git.DeltaIgnored) {
+			logger.Trace().Str("file", filePath).Msg("change filtered out by watch configuration")
+			continue
+		}
+		if delta.Status == git.DeltaDeleted {
+			logger.Trace().Str("file", delta.OldFile.Path).Msg("removing deleted file from in-memory index")
+			if err = index.RemoveByPath(delta.OldFile.Path); err != nil {
+				logger.Error().Err(err).Str("file", delta.OldFile.Path).Msg("error encountered while removing file from in-memory index")
+				index.Free()
+				return
+			}
+			continue
+		}
+		logger.Trace().Str("file", delta.NewFile.Path).Msg("adding working tree file to in-memory index")
+		if err = addWorkdirFile(repo, index, delta.NewFile.Path); err != nil {
+			logger.Error().Err(err).Str("file", delta.NewFile.Path).Msg("error encountered while adding working tree file to in-memory index")
+			index.Free()
+			return
+		}
+	}
+	logger.Debug().Uint("entries", index.EntryCount()).Msg("in-memory index updated with working tree changes")
+	log.Trace().Msg("leaving snapshotIndex")
+	return
+}
+
+// addWorkdirFile writes the working tree file at path (relative to the repository's
+// working directory) to the object database and adds the resulting blob to index. Like
+// git add, the clean filters configured for path (autocrlf, text and eol attributes,
+// filter drivers) are applied. A file which disappeared since the working tree was
+// diffed is removed from index.
+func addWorkdirFile(repo *git.Repository, index *git.Index, path string) (err error) {
+	log.Trace().Msg("entered addWorkdirFile")
+	logger := log.With().Str("repo", repo.Path()).Str("file", path).Logger()
+	var (
+		fullPath = filepath.Join(repo.Workdir(), path)
+		fileInfo os.FileInfo
+		mode     = git.FilemodeBlob
+		oid      *git.Oid
+	)
+	logger.Trace().Msgf("retrieve file information for path %s", fullPath)
+	if fileInfo, err = os.Lstat(fullPath); err != nil {
+		if os.IsNotExist(err) {
+			logger.Debug().Msg("file no longer exists, removing from in-memory index")
+			err = index.RemoveByPath(path)
+		}
+		return
+	}
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(fullPath); err != nil {
+			logger.Error().Err(err).Msg("error encountered while reading symbolic link")
+			return
+		}
+		if oid, err = repo.CreateBlobFromBuffer([]byte(target)); err != nil {
+			logger.Error().Err(err).Msg("error encountered while writing blob to repository")
+			return
+		}
+		mode = git.FilemodeLink
+	case fileInfo.IsDir():
+		// Nested repositories and submodules show up as directories, their content is
+		// not part of this repository's snapshot.
+		logger.Debug().Msg("path is a directory, skipping")
+		return
+	default:
+		if oid, err = writeFilteredBlob(repo, fullPath, path); err != nil {
+			logger.Error().Err(err).Msg("error encountered while writing blob to repository")
+			return
+		}
+		if fileInfo.Mode()&0111 != 0 {
+			mode = git.FilemodeBlobExecutable
+		}
+	}
+	modTime := fileInfo.ModTime()
+	if err = index.Add(&git.IndexEntry{
+		Mtime: git.IndexTime{Seconds: int32(modTime.Unix()), Nanoseconds: uint32(modTime.Nanosecond())},
+		Mode:  mode,
+		Size:  uint32(fileInfo.Size()),
+		Id:    oid,
+		Path:  path,
+	}); err != nil {
+		logger.Error().Err(err).Msg("error encountered while adding blob to in-memory index")
+		return
+	}
+	logger.Debug().Str("blob", oid.String()).Msg("added working tree file to in-memory index")
+	log.Trace().Msg("leaving addWorkdirFile")
+	return
+}
+
+// writeFilteredBlob writes the content of the file at fullPath to the object database of
+// repo through the clean filters configured for path (relative to the working directory).
+func writeFilteredBlob(repo *git.Repository, fullPath string, path string) (oid *git.Oid, err error) {
+	var (
+		file   *os.File
+		stream *git.BlobWriteStream
+	)
+	if file, err = os.Open(fullPath); err != nil {
+		return
+	}
+	defer file.Close()
+	if stream, err = repo.CreateFromStream(path); err != nil {
+		return
+	}
+	if _, err = io.Copy(stream, file); err != nil {
+		stream.Free()
+		return
+	}
+	// Committing the stream frees it, whether or not it succeeds
+	runtime.SetFinalizer(stream, nil)
+	return stream.Commit()
+}
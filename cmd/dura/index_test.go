@@ -0,0 +1,173 @@
+package dura
+
+import (
+	"bytes"
+	git "github.com/libgit2/git2go/v33"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// initTestRepo creates a repository in a temporary directory holding a single commit of
+// the given files.
+func initTestRepo(t *testing.T, files map[string]string) (repo *git.Repository) {
+	t.Helper()
+	var (
+		err      error
+		index    *git.Index
+		treeOid  *git.Oid
+		tree     *git.Tree
+		settings *git.Config
+	)
+	dir := t.TempDir()
+	if repo, err = git.InitRepository(dir, false); err != nil {
+		t.Fatalf("unable to init repository: %v", err)
+	}
+	if settings, err = repo.Config(); err != nil {
+		t.Fatalf("unable to open repository config: %v", err)
+	}
+	_ = settings.SetString("user.name", "Dura Test")
+	_ = settings.SetString("user.email", "dura@example.com")
+	if index, err = repo.Index(); err != nil {
+		t.Fatalf("unable to open index: %v", err)
+	}
+	for name, content := range files {
+		writeTestFile(t, repo, name, content)
+		if err = index.AddByPath(name); err != nil {
+			t.Fatalf("unable to stage %s: %v", name, err)
+		}
+	}
+	if treeOid, err = index.WriteTree(); err != nil {
+		t.Fatalf("unable to write tree: %v", err)
+	}
+	if err = index.Write(); err != nil {
+		t.Fatalf("unable to write index: %v", err)
+	}
+	if tree, err = repo.LookupTree(treeOid); err != nil {
+		t.Fatalf("unable to look up tree: %v", err)
+	}
+	sig := &git.Signature{Name: "Dura Test", Email: "dura@example.com", When: time.Now()}
+	if _, err = repo.CreateCommit("HEAD", sig, sig, "initial commit", tree); err != nil {
+		t.Fatalf("unable to commit: %v", err)
+	}
+	return
+}
+
+func writeTestFile(t *testing.T, repo *git.Repository, name string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(repo.Workdir(), name), []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write %s: %v", name, err)
+	}
+}
+
+// blobContent returns the content of the file name in the tree of the commit hash.
+func blobContent(t *testing.T, repo *git.Repository, hash string, name string) string {
+	t.Helper()
+	var (
+		err    error
+		oid    *git.Oid
+		commit *git.Commit
+		tree   *git.Tree
+		entry  *git.TreeEntry
+		blob   *git.Blob
+	)
+	if oid, err = git.NewOid(hash); err != nil {
+		t.Fatalf("invalid commit hash %s: %v", hash, err)
+	}
+	if commit, err = repo.LookupCommit(oid); err != nil {
+		t.Fatalf("unable to look up commit %s: %v", hash, err)
+	}
+	if tree, err = commit.Tree(); err != nil {
+		t.Fatalf("unable to read tree of %s: %v", hash, err)
+	}
+	if entry, err = tree.EntryByPath(name); err != nil {
+		t.Fatalf("%s is missing from the tree of %s: %v", name, hash, err)
+	}
+	if blob, err = repo.LookupBlob(entry.Id); err != nil {
+		t.Fatalf("unable to read %s: %v", name, err)
+	}
+	return string(blob.Contents())
+}
+
+func TestCaptureLeavesIndexUntouched(t *testing.T) {
+	repo := initTestRepo(t, map[string]string{"staged.txt": "one\n", "unstaged.txt": "one\n"})
+	var (
+		err   error
+		index *git.Index
+		cs    *CaptureStatus
+	)
+	// A partially staged change: staged.txt is staged, then changed again
+	writeTestFile(t, repo, "staged.txt", "two\n")
+	if index, err = repo.Index(); err != nil {
+		t.Fatalf("unable to open index: %v", err)
+	}
+	if err = index.AddByPath("staged.txt"); err != nil {
+		t.Fatalf("unable to stage staged.txt: %v", err)
+	}
+	if err = index.Write(); err != nil {
+		t.Fatalf("unable to write index: %v", err)
+	}
+	writeTestFile(t, repo, "staged.txt", "two\nthree\n")
+	writeTestFile(t, repo, "unstaged.txt", "two\n")
+
+	indexPath := filepath.Join(repo.Path(), "index")
+	before, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatalf("unable to read index: %v", err)
+	}
+	beforeInfo, err := os.Stat(indexPath)
+	if err != nil {
+		t.Fatalf("unable to stat index: %v", err)
+	}
+
+	if cs, err = Capture(repo.Workdir()); err != nil {
+		t.Fatalf("capture failed: %v", err)
+	}
+
+	after, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatalf("unable to read index: %v", err)
+	}
+	afterInfo, err := os.Stat(indexPath)
+	if err != nil {
+		t.Fatalf("unable to stat index: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("index content changed by capture")
+	}
+	if !beforeInfo.ModTime().Equal(afterInfo.ModTime()) {
+		t.Errorf("index modification time changed by capture: %v, now %v", beforeInfo.ModTime(), afterInfo.ModTime())
+	}
+
+	if got := blobContent(t, repo, cs.CommitHash, "staged.txt"); got != "two\nthree\n" {
+		t.Errorf("snapshot holds %q for staged.txt, want the working tree content", got)
+	}
+	if got := blobContent(t, repo, cs.CommitHash, "unstaged.txt"); got != "two\n" {
+		t.Errorf("snapshot holds %q for unstaged.txt, want the working tree content", got)
+	}
+}
+
+func TestCaptureAppliesCleanFilters(t *testing.T) {
+	repo := initTestRepo(t, map[string]string{"crlf.txt": "one\n"})
+	var (
+		err      error
+		settings *git.Config
+		cs       *CaptureStatus
+	)
+	if settings, err = repo.Config(); err != nil {
+		t.Fatalf("unable to open repository config: %v", err)
+	}
+	if err = settings.SetString("core.autocrlf", "true"); err != nil {
+		t.Fatalf("unable to set core.autocrlf: %v", err)
+	}
+	writeTestFile(t, repo, "crlf.txt", "one\r\ntwo\r\n")
+
+	if cs, err = Capture(repo.Workdir()); err != nil {
+		t.Fatalf("capture failed: %v", err)
+	}
+	if got := blobContent(t, repo, cs.CommitHash, "crlf.txt"); got != "one\ntwo\n" {
+		t.Errorf("snapshot holds %q for crlf.txt, want the content as committed", got)
+	}
+}
@@ -0,0 +1,209 @@
+package dura
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	heldLock     *os.File
+	lockFileName = "runtime.lock"
+	// errLockHeld is returned by lockFile when another process holds the lock
+	errLockHeld = errors.New("lock is held by another process")
+)
+
+// DaemonRunningError is returned by RuntimeLock.Acquire when another Dura daemon holds
+// the runtime lock.
+type DaemonRunningError struct {
+	Pid uint32
+}
+
+func (e *DaemonRunningError) Error() string {
+	return fmt.Sprintf("another Dura daemon is already running (pid %d)", e.Pid)
+}
+
+// LockPath returns the path of the lock file guarding the runtime database.
+func (rl *RuntimeLock) LockPath() (path string) {
+	return filepath.Join(cacheHome, lockFileName)
+}
+
+// Acquire takes the runtime lock for the current process: an exclusive advisory lock on
+// the lock file which the operating system releases when the process exits, even if it
+// crashes. If the runtime database names another process which no longer holds the lock
+// that PID is stale and gets replaced. Where advisory locks are unsupported (e.g. some
+// network file systems) the recorded PID is only considered stale if it isn't alive.
+func (rl *RuntimeLock) Acquire() (err error) {
+	log.Trace().Msg("entered Acquire")
+	if heldLock != nil {
+		log.Debug().Msg("runtime lock already held by this process")
+		return
+	}
+	var (
+		file   *os.File
+		pid    = uint32(os.Getpid())
+		locked = true
+	)
+	log.Trace().Msgf("creating cache directory %s", cacheHome)
+	if err = os.MkdirAll(cacheHome, 0755); err != nil {
+		log.Error().Err(err).Msgf("error encountered attempting to create cache directory %s", cacheHome)
+		return
+	}
+	log.Trace().Msgf("opening lock file %s", rl.LockPath())
+	if file, err = os.OpenFile(rl.LockPath(), os.O_RDWR|os.O_CREATE, os.FileMode(fileMode)); err != nil {
+		log.Error().Err(err).Msgf("error encountered attempting to open lock file %s", rl.LockPath())
+		return
+	}
+	if err = lockFile(file); err != nil {
+		if errors.Is(err, errLockHeld) {
+			holder := readLockPid(file)
+			file.Close()
+			if holder == 0 && rl.Load() == nil && rl.Pid != nil {
+				holder = *rl.Pid
+			}
+			err = &DaemonRunningError{Pid: holder}
+			log.Error().Err(err).Msg("runtime lock is held by another process")
+			return
+		}
+		log.Warn().Err(err).Msg("advisory file locks unavailable, falling back to checking whether the recorded PID is alive")
+		locked = false
+	}
+
+	log.Trace().Msg("loading runtime database")
+	if loadErr := rl.Load(); loadErr != nil {
+		log.Debug().Err(loadErr).Msg("runtime database could not be loaded, assuming no PID is recorded")
+		rl.Pid = nil
+	}
+	if rl.Pid != nil && *rl.Pid != pid {
+		alive := processAlive(*rl.Pid)
+		if !locked && alive {
+			file.Close()
+			err = &DaemonRunningError{Pid: *rl.Pid}
+			log.Error().Err(err).Msg("recorded PID is alive, refusing to take over runtime lock")
+			return
+		}
+		log.Warn().Uint32("stale", *rl.Pid).Bool("alive", alive).Msgf("process %d does not hold the runtime lock, taking over stale lock", *rl.Pid)
+	}
+
+	log.Trace().Msg("writing PID to lock file")
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(fmt.Sprintf("%d\n", pid)), 0)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("error encountered attempting to write PID to lock file %s", rl.LockPath())
+		unlockFile(file)
+		file.Close()
+		return
+	}
+	heldLock = file
+	rl.Pid = &pid
+	log.Trace().Msg("saving runtime database")
+	if err = rl.Save(); err != nil {
+		log.Error().Err(err).Msg("error encountered while saving runtime database")
+		rl.Release()
+		return
+	}
+	log.Info().Uint32("pid", pid).Msg("runtime lock acquired")
+	log.Trace().Msg("leaving Acquire")
+	return
+}
+
+// Release gives up the runtime lock taken by Acquire and clears the PID from the runtime
+// database. It does nothing if the lock isn't held by this process.
+func (rl *RuntimeLock) Release() (err error) {
+	log.Trace().Msg("entered Release")
+	if heldLock == nil {
+		log.Debug().Msg("runtime lock not held by this process, nothing to release")
+		return
+	}
+	pid := uint32(os.Getpid())
+	if loadErr := rl.Load(); loadErr != nil {
+		log.Warn().Err(loadErr).Msg("runtime database could not be loaded while releasing runtime lock")
+	}
+	if rl.Pid == nil || *rl.Pid == pid {
+		rl.Pid = nil
+		if err = rl.Save(); err != nil {
+			log.Error().Err(err).Msg("error encountered while clearing PID from runtime database")
+		}
+	}
+	heldLock.Truncate(0)
+	if unlockErr := unlockFile(heldLock); unlockErr != nil {
+		log.Error().Err(unlockErr).Msg("error encountered while unlocking lock file")
+	}
+	heldLock.Close()
+	heldLock = nil
+	log.Info().Uint32("pid", pid).Msg("runtime lock released")
+	log.Trace().Msg("leaving Release")
+	return
+}
+
+// Holder returns the PID of the Dura daemon holding the runtime lock, or nil if no
+// daemon is running. ErrDaemonPidUnknown is returned if the lock is held but its holder
+// hasn't recorded its PID.
+func (rl *RuntimeLock) Holder() (pid *uint32, err error) {
+	log.Trace().Msg("entered Holder")
+	if heldLock != nil {
+		self := uint32(os.Getpid())
+		return &self, nil
+	}
+	var file *os.File
+	if file, err = os.OpenFile(rl.LockPath(), os.O_RDWR, os.FileMode(fileMode)); err != nil {
+		if os.IsNotExist(err) {
+			log.Debug().Msg("lock file does not exist, no daemon is running")
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+	if err = lockFile(file); err == nil {
+		log.Debug().Msg("runtime lock is free, no daemon is running")
+		unlockFile(file)
+		return
+	}
+	if errors.Is(err, errLockHeld) {
+		err = nil
+		holder := readLockPid(file)
+		if holder == 0 && rl.Load() == nil && rl.Pid != nil {
+			holder = *rl.Pid
+		}
+		if holder == 0 {
+			err = ErrDaemonPidUnknown
+			log.Debug().Err(err).Msg("runtime lock is held")
+			return
+		}
+		log.Debug().Uint32("pid", holder).Msg("runtime lock is held")
+		return &holder, nil
+	}
+	log.Debug().Err(err).Msg("advisory file locks unavailable, checking whether the recorded PID is alive")
+	err = nil
+	if rl.Load() == nil && rl.Pid != nil && *rl.Pid != 0 && processAlive(*rl.Pid) {
+		holder := *rl.Pid
+		pid = &holder
+	}
+	log.Trace().Msg("leaving Holder")
+	return
+}
+
+// readLockPid returns the PID written to the lock file, or 0 if there is none.
+func readLockPid(file *os.File) uint32 {
+	var (
+		data []byte
+		pid  uint64
+		err  error
+	)
+	if _, err = file.Seek(0, 0); err != nil {
+		return 0
+	}
+	if data, err = ioutil.ReadAll(file); err != nil {
+		return 0
+	}
+	if pid, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32); err != nil {
+		return 0
+	}
+	return uint32(pid)
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package dura
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(file *os.File) (err error) {
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		err = errLockHeld
+	}
+	return
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// processAlive reports whether a process with the given PID exists, a process owned by
+// another user (EPERM) still counts as alive.
+func processAlive(pid uint32) bool {
+	err := syscall.Kill(int(pid), 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// terminateProcess asks the process with the given PID to shut down (SIGTERM).
+func terminateProcess(pid uint32) error {
+	return syscall.Kill(int(pid), syscall.SIGTERM)
+}
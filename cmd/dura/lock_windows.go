@@ -0,0 +1,54 @@
+//go:build windows
+// +build windows
+
+package dura
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// stillActive is the exit code Windows reports for processes that are still running
+const stillActive = 259
+
+func lockFile(file *os.File) (err error) {
+	if err = windows.LockFileEx(
+		windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0,
+		1,
+		0,
+		&windows.Overlapped{},
+	); err == windows.ERROR_LOCK_VIOLATION {
+		err = errLockHeld
+	}
+	return
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
+
+// processAlive reports whether a process with the given PID is still running.
+func processAlive(pid uint32) bool {
+	var (
+		handle windows.Handle
+		code   uint32
+		err    error
+	)
+	if handle, err = windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid); err != nil {
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(handle)
+	if err = windows.GetExitCodeProcess(handle, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
+
+// terminateProcess would ask the process with the given PID to shut down, Windows has no
+// equivalent of SIGTERM for console processes so only forced kills are supported.
+func terminateProcess(pid uint32) error {
+	return errors.New("graceful shutdown is not supported on Windows, use --force to kill the daemon")
+}
@@ -1,7 +1,8 @@
 package dura
 
 type Operation struct {
-	Snapshot OperationSnapshot `json:"snapshot"`
+	Snapshot *OperationSnapshot `json:"snapshot,omitempty"`
+	Backup   *OperationBackup   `json:"backup,omitempty"`
 }
 
 type OperationSnapshot struct {
@@ -11,6 +12,17 @@ type OperationSnapshot struct {
 	Latency float32        `json:"latency"`
 }
 
+type OperationBackup struct {
+	Repo    string        `json:"repo"`
+	Op      *BackupResult `json:"op,omitempty"`
+	Error   *string       `json:"error,omitempty"`
+	Latency float32       `json:"latency"`
+}
+
 func (o *Operation) ShouldLog() bool {
-	return o.Snapshot.Op != nil || o.Snapshot.Error != nil
+	if o.Backup != nil {
+		// Backups which pushed nothing are left out like captures which found no change
+		return o.Backup.Error != nil || o.Backup.Op != nil && (len(o.Backup.Op.Pushed) > 0 || len(o.Backup.Op.Deleted) > 0)
+	}
+	return o.Snapshot != nil && (o.Snapshot.Op != nil || o.Snapshot.Error != nil)
 }
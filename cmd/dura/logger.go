@@ -2,6 +2,19 @@ package dura
 
 import (
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	logWriter *lumberjack.Logger
+	// logAgeCheckInterval is how often the age of the log file is checked against
+	// dura.log_max_age_days
+	logAgeCheckInterval = time.Hour
 )
 
 func init() {
@@ -16,3 +29,71 @@ func SetGlobalLogLevel(level string) (err error) {
 	zerolog.SetGlobalLevel(logLevel)
 	return
 }
+
+// SetLogFile directs the global logger to the file at path. The file is rotated once it
+// grows beyond dura.log_max_size_mb megabytes or has been written to for
+// dura.log_max_age_days days, rotated files are removed after dura.log_max_age_days days
+// and only the newest dura.log_max_backups of them are kept (gzip compressed if
+// dura.log_compress is set). On SIGHUP the file is closed and then reopened by the next
+// write, so external tools like logrotate can move it away.
+func SetLogFile(path string) (err error) {
+	log.Trace().Msg("entered SetLogFile")
+	settings := currentConfig()
+	logWriter = &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    settings.Dura.LogMaxSizeMB,
+		MaxAge:     settings.Dura.LogMaxAgeDays,
+		MaxBackups: settings.Dura.LogMaxBackups,
+		LocalTime:  true,
+		Compress:   settings.Dura.LogCompress,
+	}
+	log.Trace().Msgf("opening log file %s", path)
+	if _, err = logWriter.Write(nil); err != nil {
+		log.Error().Err(err).Msgf("error encountered attempting to open log file %s", path)
+		logWriter = nil
+		return
+	}
+	log.Info().Str("file", path).Int("maxSizeMB", logWriter.MaxSize).Int("maxAgeDays", logWriter.MaxAge).Int("maxBackups", logWriter.MaxBackups).Bool("compress", logWriter.Compress).Msg("directing log output to file")
+	log.Logger = zerolog.New(logWriter).With().Timestamp().Logger()
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func(writer *lumberjack.Logger, maxAge time.Duration) {
+		// lumberjack only rotates by size, the age of the file is counted from when it was
+		// opened (or last rotated) by this process
+		opened := time.Now()
+		ticker := time.NewTicker(logAgeCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hangups:
+				if err := writer.Close(); err != nil {
+					log.Error().Err(err).Msg("error encountered while closing log file on SIGHUP")
+					continue
+				}
+				opened = time.Now()
+				log.Info().Msg("log file reopened after SIGHUP")
+			case now := <-ticker.C:
+				if maxAge <= 0 || now.Sub(opened) < maxAge {
+					continue
+				}
+				if err := writer.Rotate(); err != nil {
+					log.Error().Err(err).Msg("error encountered while rotating log file by age")
+					continue
+				}
+				opened = now
+				log.Info().Dur("maxAge", maxAge).Msg("log file rotated by age")
+			}
+		}
+	}(logWriter, time.Duration(settings.Dura.LogMaxAgeDays)*24*time.Hour)
+	log.Trace().Msg("leaving SetLogFile")
+	return
+}
+
+// CloseLogFile closes the log file set by SetLogFile, if any.
+func CloseLogFile() (err error) {
+	if logWriter != nil {
+		err = logWriter.Close()
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package dura
+
+import (
+	"bytes"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// TriggerPoll marks captures made by the polling loop
+	TriggerPoll = "poll"
+	// TriggerFsEvent marks captures made after file system events in watch mode
+	TriggerFsEvent = "fsevent"
+	// TriggerManual marks captures requested with dura capture
+	TriggerManual = "manual"
+)
+
+const (
+	// DefMessageTemplate is the commit.message_template used when none is configured
+	DefMessageTemplate = `dura auto-backup: {{len .Files}} {{if eq (len .Files) 1}}file{{else}}files{{end}} changed on {{.BaseBranch}}
+
+{{.Stat}}`
+
+	trailerBase    = "Dura-Base"
+	trailerBranch  = "Dura-Branch"
+	trailerHost    = "Dura-Host"
+	trailerTrigger = "Dura-Trigger"
+	// trailerPrevious links a snapshot to the one it continues from, see CommitConfig.Lineage
+	trailerPrevious = "Dura-Previous"
+)
+
+// MessageData is the data available to commit.message_template.
+type MessageData struct {
+	// Files are the paths changed by the snapshot, relative to the repository root
+	Files      []string
+	Insertions int
+	Deletions  int
+	// Stat is a diffstat of the changes
+	Stat string
+	// BaseBranch is the branch checked out when capturing, HEAD if detached
+	BaseBranch string
+	// BaseHash is the hash of the commit checked out when capturing, empty if the branch
+	// has no commits yet
+	BaseHash string
+	Hostname string
+	// Trigger is what caused the capture, one of TriggerPoll, TriggerFsEvent and TriggerManual
+	Trigger string
+	Time    time.Time
+	// Previous is the hash of the snapshot taken before HEAD moved, empty unless lineage
+	// is enabled and this is the first snapshot since
+	Previous string
+}
+
+// newMessageData collects the message data for a snapshot of repo on top of head with
+// the changes in diff. A nil head stands for the unborn branch of a repository without
+// commits, BaseHash is empty then.
+func newMessageData(repo *git.Repository, head *git.Commit, diff *git.Diff, trigger string, when time.Time) (data *MessageData, err error) {
+	log.Trace().Msg("entered newMessageData")
+	data = &MessageData{
+		BaseBranch: "HEAD",
+		Trigger:    trigger,
+		Time:       when,
+	}
+	if head != nil {
+		data.BaseHash = head.Id().String()
+	} else {
+		data.BaseBranch = unbornBranch(repo)
+	}
+	if data.Hostname, err = os.Hostname(); err != nil {
+		log.Warn().Err(err).Msg("unable to retrieve hostname")
+		data.Hostname, err = "unknown", nil
+	}
+	if ref, headErr := repo.Head(); headErr == nil && ref.IsBranch() {
+		data.BaseBranch = ref.Shorthand()
+	}
+	var deltas int
+	if deltas, err = diff.NumDeltas(); err != nil {
+		return
+	}
+	for i := 0; i < deltas; i++ {
+		var delta git.DiffDelta
+		if delta, err = diff.Delta(i); err != nil {
+			return
+		}
+		file := delta.NewFile.Path
+		if delta.Status == git.DeltaDeleted {
+			file = delta.OldFile.Path
+		}
+		data.Files = append(data.Files, file)
+	}
+	var stats *git.DiffStats
+	if stats, err = diff.Stats(); err != nil {
+		return
+	}
+	defer stats.Free()
+	data.Insertions = stats.Insertions()
+	data.Deletions = stats.Deletions()
+	if data.Stat, err = stats.String(git.DiffStatsFull, 72); err != nil {
+		return
+	}
+	data.Stat = strings.TrimRight(data.Stat, "\n")
+	log.Trace().Msg("leaving newMessageData")
+	return
+}
+
+// commitMessage renders tmpl (DefMessageTemplate if empty) with data and appends the
+// Dura trailers. A template which fails to parse or execute is logged and replaced with
+// DefMessageTemplate.
+func commitMessage(tmpl string, data *MessageData) string {
+	log.Trace().Msg("entered commitMessage")
+	if tmpl == "" {
+		tmpl = DefMessageTemplate
+	}
+	var (
+		buf bytes.Buffer
+		t   *template.Template
+		err error
+	)
+	if t, err = template.New("message").Parse(tmpl); err == nil {
+		err = t.Execute(&buf, data)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("error encountered while rendering commit message template, using default")
+		buf.Reset()
+		template.Must(template.New("message").Parse(DefMessageTemplate)).Execute(&buf, data)
+	}
+	message := strings.TrimSpace(buf.String())
+	if message == "" {
+		message = "dura auto-backup"
+	}
+	message += "\n\n"
+	for _, trailer := range [][2]string{
+		{trailerBase, data.BaseHash},
+		{trailerBranch, data.BaseBranch},
+		{trailerHost, data.Hostname},
+		{trailerTrigger, data.Trigger},
+		{trailerPrevious, data.Previous},
+	} {
+		// Dura-Base is left out on unborn branches and Dura-Previous unless lineage links one
+		if trailer[1] != "" {
+			message += fmt.Sprintf("%s: %s\n", trailer[0], trailer[1])
+		}
+	}
+	log.Trace().Msg("leaving commitMessage")
+	return message
+}
@@ -0,0 +1,348 @@
+package dura
+
+import (
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MigrateOptions configures Migrate.
+type MigrateOptions struct {
+	// Namespace is the target ref namespace, the configured namespace if empty
+	Namespace string
+	// DryRun only plans the moves, no ref is changed
+	DryRun bool
+}
+
+// RefMove is the move of a Dura ref planned or made by Migrate.
+type RefMove struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Commit string `json:"commit"`
+	// Exists is true when To already points to Commit, From is only removed
+	Exists bool `json:"exists,omitempty"`
+	// Archived is true when From clashes with a ref holding newer snapshots, To is then
+	// a suffixed name in ArchiveRefNamespace
+	Archived bool `json:"archived,omitempty"`
+	// Replaces is the commit To points to before the move, which is archived by
+	// another move of the same migration
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// MigrateResult is the outcome of migrating the Dura refs of a repository.
+type MigrateResult struct {
+	Repo  string    `json:"repo"`
+	Moves []RefMove `json:"moves"`
+	Error string    `json:"error,omitempty"`
+}
+
+// MigrateConflictError is returned when Dura refs can't be moved without overwriting
+// archived refs pointing to other commits, nothing is changed in that case.
+type MigrateConflictError struct {
+	Conflicts []string
+}
+
+func (e *MigrateConflictError) Error() string {
+	return fmt.Sprintf("refusing to overwrite refs pointing to other commits: %s", strings.Join(e.Conflicts, ", "))
+}
+
+// Migrate moves every Dura ref of the repository at path (in the legacy layout or the
+// configured one, within the configured or a previous namespace) to the layout given by the configured ref pattern within
+// opts.Namespace. The refs keep pointing to the same commits, so the history of the
+// snapshots is preserved, and refs already in the target layout are left untouched, so
+// Migrate may safely be run again.
+//
+// Refs ending up with the same name (e.g. a legacy ref and the ref created for the same
+// base commit once the layout changed) are merged: the ref whose tip is the newest keeps
+// the name and the others are archived, see migrationArchive.
+//
+// The move is all or nothing: every target ref is created before any source ref is
+// removed, and created refs are removed (or reset) again if one of them fails.
+func Migrate(path string, opts MigrateOptions) (moves []RefMove, err error) {
+	log.Trace().Msg("entered Migrate")
+	logger := log.With().Str("path", path).Logger()
+	var (
+		repo  *git.Repository
+		store *git.Repository
+	)
+	if repo, err = OpenRepository(path); err != nil {
+		return
+	}
+	if store, err = duraStore(repo); err != nil {
+		return
+	}
+	namespace := strings.TrimRight(opts.Namespace, "/")
+	if namespace == "" {
+		namespace = refNamespace()
+	} else if !strings.HasPrefix(namespace, "refs/") {
+		err = fmt.Errorf("'%s' is not a valid ref namespace, it must start with refs/", namespace)
+		logger.Error().Err(err).Msg("error encountered while migrating Dura refs")
+		return
+	}
+	if moves, err = planMigration(repo, namespace, currentConfig().WatchConfigFor(repo.Workdir())); err != nil {
+		return
+	}
+	logger.Debug().Int("moves", len(moves)).Str("namespace", namespace).Msg("migration planned")
+	if opts.DryRun || len(moves) == 0 {
+		log.Trace().Msg("leaving Migrate")
+		return
+	}
+
+	// Archives are created first, so the refs they replace are saved before being overwritten
+	var (
+		created  []RefMove
+		replaced = map[string]bool{}
+		ordered  []RefMove
+	)
+	for _, move := range moves {
+		if move.Archived {
+			ordered = append(ordered, move)
+		}
+	}
+	for _, move := range moves {
+		if !move.Archived {
+			ordered = append(ordered, move)
+		}
+		if move.Replaces != "" {
+			replaced[move.To] = true
+		}
+	}
+	for _, move := range ordered {
+		if move.Exists {
+			continue
+		}
+		var oid *git.Oid
+		if oid, err = git.NewOid(move.Commit); err == nil {
+			_, err = store.References.Create(move.To, oid, move.Replaces != "", fmt.Sprintf("dura migrate: moved from %s", move.From))
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("ref", move.To).Msg("error encountered while creating ref, rolling back")
+			for _, done := range created {
+				if done.Replaces != "" {
+					if replaces, oidErr := git.NewOid(done.Replaces); oidErr == nil {
+						if _, resetErr := store.References.Create(done.To, replaces, true, "dura migrate: rolled back"); resetErr != nil {
+							logger.Error().Err(resetErr).Str("ref", done.To).Msg("error encountered while resetting replaced ref")
+						}
+					}
+				} else if ref, lookupErr := store.References.Lookup(done.To); lookupErr == nil {
+					if deleteErr := ref.Delete(); deleteErr != nil {
+						logger.Error().Err(deleteErr).Str("ref", done.To).Msg("error encountered while removing created ref")
+					}
+				}
+			}
+			return
+		}
+		created = append(created, move)
+	}
+	for _, move := range moves {
+		if replaced[move.From] {
+			// The archived ref was overwritten by the ref which kept its name
+			continue
+		}
+		var ref *git.Reference
+		if ref, err = store.References.Lookup(move.From); err == nil {
+			if ref.Target() == nil || ref.Target().String() != move.Commit {
+				// A snapshot was taken meanwhile, keep it for the next migration
+				logger.Warn().Str("ref", move.From).Msg("ref changed during migration, leaving it in place")
+				continue
+			}
+			err = ref.Delete()
+		}
+		if err != nil {
+			// Every target exists at this point, running the migration again removes what's left
+			logger.Error().Err(err).Str("ref", move.From).Msg("error encountered while removing migrated ref")
+			return
+		}
+	}
+	logger.Info().Int("moves", len(moves)).Str("namespace", namespace).Msg("migrated Dura refs")
+	log.Trace().Msg("leaving Migrate")
+	return
+}
+
+// MigrateAll runs Migrate on every repository watched, a repository which fails to
+// migrate is reported in its result and doesn't stop the others.
+func MigrateAll(opts MigrateOptions) (results []MigrateResult) {
+	log.Trace().Msg("entered MigrateAll")
+	for root, wc := range currentConfig().GitRepos() {
+		repos, err := discoverRepos(root, wc)
+		if err != nil {
+			log.Error().Err(err).Msgf("error encountered while discovering repositories in '%s', will continue", root)
+			results = append(results, MigrateResult{Repo: root, Error: err.Error()})
+			continue
+		}
+		for _, repo := range repos {
+			result := MigrateResult{Repo: repo}
+			if result.Moves, err = Migrate(repo, opts); err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Repo < results[j].Repo })
+	log.Trace().Msg("leaving MigrateAll")
+	return
+}
+
+// planMigration returns the moves bringing the Dura refs of repo to the configured ref
+// pattern within namespace. Of the refs ending up with the same name, including the one
+// already there, the one whose tip was committed last keeps it and the others are moved
+// to migrationArchive.
+func planMigration(repo *git.Repository, namespace string, wc WatchConfig) (moves []RefMove, err error) {
+	log.Trace().Msg("entered planMigration")
+	var (
+		refs      []string
+		conflicts []string
+		targets   []string
+		// claims maps each target ref to the moves ending up at it
+		claims = map[string][]RefMove{}
+		times  = map[string]time.Time{}
+		// archives maps the archive refs planned to their commit
+		archives = map[string]string{}
+	)
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	pattern := refPattern(namespace)
+	for _, name := range refs {
+		var commit *git.Commit
+		if commit, err = lookupRefCommit(repo, name); err != nil || commit == nil {
+			if err == nil {
+				err = fmt.Errorf("ref %s disappeared", name)
+			}
+			return
+		}
+		move := RefMove{From: name, Commit: commit.Id().String()}
+		if move.To, err = expandRefName(namespace, pattern, migrationFields(name, commit, wc)); err != nil {
+			return
+		}
+		if move.To == move.From {
+			continue
+		}
+		if _, ok := claims[move.To]; !ok {
+			targets = append(targets, move.To)
+		}
+		claims[move.To] = append(claims[move.To], move)
+		times[move.Commit] = commit.Committer().When
+	}
+
+	// archive plans moving move to the archive of target, which may exist from an
+	// earlier, interrupted migration
+	archive := func(move RefMove, target string) (err error) {
+		move.To, move.Archived = migrationArchive(target, move.Commit), true
+		if _, ok := archives[move.To]; !ok {
+			var existing *git.Commit
+			if existing, err = lookupRefCommit(repo, move.To); err != nil {
+				return
+			}
+			if existing != nil && existing.Id().String() != move.Commit {
+				conflicts = append(conflicts, move.To)
+				return
+			}
+			move.Exists = existing != nil
+			archives[move.To] = move.Commit
+		} else {
+			move.Exists = true
+		}
+		moves = append(moves, move)
+		return
+	}
+	for _, target := range targets {
+		var (
+			existing   *git.Commit
+			newest     string
+			newestTime time.Time
+		)
+		if existing, err = lookupRefCommit(repo, target); err != nil {
+			return
+		}
+		// Ties go to the ref already there, then to the first ref claiming the name
+		if existing != nil {
+			newest, newestTime = existing.Id().String(), existing.Committer().When
+		}
+		for _, move := range claims[target] {
+			if newest == "" || times[move.Commit].After(newestTime) {
+				newest, newestTime = move.Commit, times[move.Commit]
+			}
+		}
+		placed := false
+		if existing != nil {
+			if placed = existing.Id().String() == newest; !placed {
+				if err = archive(RefMove{From: target, Commit: existing.Id().String()}, target); err != nil {
+					return
+				}
+			}
+		}
+		for _, move := range claims[target] {
+			switch {
+			case move.Commit != newest:
+				if err = archive(move, target); err != nil {
+					return
+				}
+				continue
+			case placed:
+				move.Exists = true
+			default:
+				placed = true
+				if existing != nil {
+					move.Replaces = existing.Id().String()
+				}
+			}
+			moves = append(moves, move)
+		}
+	}
+	if len(conflicts) > 0 {
+		moves = nil
+		err = &MigrateConflictError{Conflicts: conflicts}
+		log.Error().Err(err).Str("repo", repo.Path()).Msg("Dura refs can't be migrated")
+		return
+	}
+	log.Trace().Msg("leaving planMigration")
+	return
+}
+
+// migrationArchive returns the name under which Migrate archives the ref holding commit
+// which clashed with target: target within ArchiveRefNamespace (where dura gc --archive
+// puts collected refs), suffixed with the abbreviated commit.
+func migrationArchive(target string, commit string) string {
+	return fmt.Sprintf("%s/%s-%s", ArchiveRefNamespace, strings.TrimPrefix(target, "refs/"), commit[:7])
+}
+
+// migrationFields recovers the ref pattern placeholder values of an existing Dura ref:
+// the branch prefix it contains (the one of wc if none), its base commit and the branch
+// and host recorded in the trailers of its newest snapshot. The refs of unborn branches
+// are named after the branch recorded.
+func migrationFields(name string, commit *git.Commit, wc WatchConfig) (fields refFields) {
+	fields = refFields{
+		Prefix: branchPrefix(wc),
+		Head:   refBase(name),
+		Branch: "detached",
+		Host:   hostname(),
+	}
+	defer func() {
+		if fields.Head == "" {
+			fields.Head = unbornHead(fields.Branch)
+		}
+	}()
+	for _, prefix := range currentConfig().BranchPrefixes() {
+		if strings.Contains("/"+name+"/", "/"+prefix+"/") {
+			fields.Prefix = prefix
+			break
+		}
+	}
+	trailers, err := git.MessageTrailers(commit.RawMessage())
+	if err != nil {
+		return
+	}
+	for _, trailer := range trailers {
+		switch {
+		case trailer.Key == trailerBranch && trailer.Value != "HEAD" && sanitizeRefPart(trailer.Value) != "":
+			fields.Branch = trailer.Value
+		case trailer.Key == trailerHost && sanitizeRefPart(trailer.Value) != "":
+			fields.Host = trailer.Value
+		}
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package dura
+
+import (
+	"errors"
+	git "github.com/libgit2/git2go/v33"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMove is a RefMove whose refs and commits are named symbolically: refs are
+// "legacy", "old" (the previous namespace), "target" or "archive:<snapshot>", commits
+// are snapshot names.
+type testMove struct {
+	from, to, commit string
+	exists, archived bool
+	replaces         string
+}
+
+func TestPlanMigration(t *testing.T) {
+	tests := []struct {
+		name string
+		// refs maps the refs created before planning to their snapshot
+		refs     map[string]string
+		want     []testMove
+		conflict bool
+	}{
+		{
+			name: "legacy ref is moved",
+			refs: map[string]string{"legacy": "s1"},
+			want: []testMove{{from: "legacy", to: "target", commit: "s1"}},
+		},
+		{
+			name: "ref in a previous namespace is moved",
+			refs: map[string]string{"old": "s1"},
+			want: []testMove{{from: "old", to: "target", commit: "s1"}},
+		},
+		{
+			name: "ref already in the target layout is left alone",
+			refs: map[string]string{"target": "s1"},
+		},
+		{
+			name: "newer ref replaces the existing one, which is archived",
+			refs: map[string]string{"target": "s1", "legacy": "s2"},
+			want: []testMove{
+				{from: "target", to: "archive:s1", commit: "s1", archived: true},
+				{from: "legacy", to: "target", commit: "s2", replaces: "s1"},
+			},
+		},
+		{
+			name: "older ref is archived",
+			refs: map[string]string{"target": "s2", "legacy": "s1"},
+			want: []testMove{{from: "legacy", to: "archive:s1", commit: "s1", archived: true}},
+		},
+		{
+			name: "newest of the clashing refs keeps the name",
+			refs: map[string]string{"legacy": "s1", "old": "s2"},
+			want: []testMove{
+				{from: "legacy", to: "archive:s1", commit: "s1", archived: true},
+				{from: "old", to: "target", commit: "s2"},
+			},
+		},
+		{
+			name: "archive left by an interrupted migration is reused",
+			refs: map[string]string{"target": "s2", "legacy": "s1", "archive:s1": "s1"},
+			want: []testMove{{from: "legacy", to: "archive:s1", commit: "s1", exists: true, archived: true}},
+		},
+		{
+			name:     "archive pointing to another commit is a conflict",
+			refs:     map[string]string{"target": "s2", "legacy": "s1", "archive:s1": "s3"},
+			conflict: true,
+		},
+	}
+	commitConfig := CommitConfig{RefNamespace: "refs/dura", PreviousRefNamespaces: []string{"refs/old"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCommitConfig(t, commitConfig, func() {
+				repo := initTestRepo(t, map[string]string{"file.txt": "one\n"})
+				head, err := headPeelToCommit(repo)
+				if err != nil {
+					t.Fatalf("unable to read HEAD: %v", err)
+				}
+				now := time.Now()
+				ids := map[string]string{}
+				for i, name := range []string{"s1", "s2", "s3"} {
+					ids[name] = testSnapshot(t, repo, name, now.Add(time.Duration(i)*time.Minute), head).Id().String()
+				}
+				base := head.Id().String()
+				refName := func(name string) string {
+					switch {
+					case name == "legacy":
+						return "refs/heads/dura/" + base
+					case name == "old":
+						return "refs/old/dura/" + base
+					case name == "target":
+						return "refs/dura/dura/" + base
+					case strings.HasPrefix(name, "archive:"):
+						return migrationArchive("refs/dura/dura/"+base, ids[strings.TrimPrefix(name, "archive:")])
+					}
+					t.Fatalf("unknown test ref %s", name)
+					return ""
+				}
+				for name, snapshot := range tt.refs {
+					oid, _ := git.NewOid(ids[snapshot])
+					if _, err = repo.References.Create(refName(name), oid, false, "test"); err != nil {
+						t.Fatalf("unable to create %s: %v", name, err)
+					}
+				}
+
+				moves, err := planMigration(repo, "refs/dura", WatchConfig{})
+				if tt.conflict {
+					var conflict *MigrateConflictError
+					if !errors.As(err, &conflict) || moves != nil {
+						t.Fatalf("planned %v, %v, want a conflict", moves, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("planning failed: %v", err)
+				}
+				var want []RefMove
+				for _, m := range tt.want {
+					move := RefMove{From: refName(m.from), To: refName(m.to), Commit: ids[m.commit], Exists: m.exists, Archived: m.archived}
+					if m.replaces != "" {
+						move.Replaces = ids[m.replaces]
+					}
+					want = append(want, move)
+				}
+				if !reflect.DeepEqual(moves, want) {
+					t.Errorf("planned %+v, want %+v", moves, want)
+				}
+			})
+		})
+	}
+}
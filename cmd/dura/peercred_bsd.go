@@ -0,0 +1,36 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package dura
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// peerUID returns the user ID of the process on the other end of the Unix socket conn.
+func peerUID(conn net.Conn) (uid int, err error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, errors.New("not a unix socket connection")
+	}
+	var (
+		raw   syscall.RawConn
+		cred  *unix.Xucred
+		opErr error
+	)
+	if raw, err = unixConn.SyscallConn(); err != nil {
+		return -1, err
+	}
+	if err = raw.Control(func(fd uintptr) {
+		cred, opErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	}); err != nil {
+		return -1, err
+	}
+	if opErr != nil {
+		return -1, opErr
+	}
+	return int(cred.Uid), nil
+}
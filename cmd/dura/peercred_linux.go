@@ -0,0 +1,33 @@
+package dura
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// peerUID returns the user ID of the process on the other end of the Unix socket conn.
+func peerUID(conn net.Conn) (uid int, err error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, errors.New("not a unix socket connection")
+	}
+	var (
+		raw   syscall.RawConn
+		cred  *unix.Ucred
+		opErr error
+	)
+	if raw, err = unixConn.SyscallConn(); err != nil {
+		return -1, err
+	}
+	if err = raw.Control(func(fd uintptr) {
+		cred, opErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return -1, err
+	}
+	if opErr != nil {
+		return -1, opErr
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package dura
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID is unsupported on this platform, so control connections are always rejected.
+func peerUID(conn net.Conn) (uid int, err error) {
+	return -1, errors.New("peer credentials are not supported on this platform")
+}
@@ -2,11 +2,11 @@ package dura
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	//"log"
-	"os"
 	"time"
 )
 
@@ -14,26 +14,30 @@ import (
 //	runtimeLock = RuntimeLock{}
 //}
 
-func processDirectory(currentPath string) (err error) {
+func processDirectory(currentPath string, filter *watchFilter, trigger string) (err error) {
 	log.Debug().Str("currentPath", currentPath).Msg("entered processDirectory")
 	var (
 		op        *CaptureStatus
 		operation Operation
 	)
+	captureMu.Lock()
+	defer captureMu.Unlock()
 	log.Trace().Msg("starting latency timer")
 	start := time.Now()
 	log.Trace().Msgf("calling capture on path: %s", currentPath)
-	if op, err = Capture(currentPath); err != nil {
+	if op, err = captureWithFilter(currentPath, filter, trigger); err != nil {
 		log.Error().Err(err)
 	}
 	if op != nil {
 		log.Trace().Dict("op", zerolog.Dict().Str("DuraBranch", op.DuraBranch).Str("CommitHash", op.CommitHash).Str("BaseHash", op.BaseHash))
 	}
-	latency := float32(time.Since(start))
+	elapsed := time.Since(start)
+	recordCapture(currentPath, op, err, elapsed)
+	latency := float32(elapsed)
 	log.Trace().Msgf("stopped latency timer, latency was %dns", latency)
 
 	log.Trace().Msg("initializing operation")
-	operation = Operation{OperationSnapshot{
+	operation = Operation{Snapshot: &OperationSnapshot{
 		Repo:    currentPath,
 		Latency: latency,
 	}}
@@ -73,71 +77,121 @@ func processDirectory(currentPath string) (err error) {
 		//fmt.Println(string(bytes))
 		log.Info().RawJSON("result", bytes).Msg("")
 	}
+	if op != nil && err == nil {
+		backupAfterCapture(currentPath, true)
+	}
 
 	log.Trace().Msg("leaving processDirectory")
 	return
 }
 
-// TODO fix PID issue so that it enforces only one instance of the poller
 func doTask() {
 	log.Trace().Msg("entered doTask")
 
-	log.Trace().Msg("loading runtimeLock")
-	if err = runtimeLock.Load(); err != nil {
-		log.Error().Err(err).Msg("error encountered while retrieving runtimeLock")
-	}
-	pid := uint32(os.Getpid())
-	log.Info().Uint32("pid", pid).Msg("current process PID retrieved")
-	if runtimeLock.Pid != nil && pid != *runtimeLock.Pid {
-		log.Warn().Msgf("Shutting down because process %d has runtime lock", runtimeLock.Pid)
-		os.Exit(0)
-	}
-
-	var repo string
+	var (
+		root  string
+		wc    WatchConfig
+		repos []string
+	)
 	log.Trace().Msg("entering repository loop")
-	for repo = range config.GitRepos() {
-		log.Debug().Str("repo", repo).Msg("processing repository")
-		log.Trace().Msgf("calling processDirectory for '%s'", repo)
-		if err = processDirectory(repo); err != nil {
-			log.Error().Err(err).Msgf("error encountered while processing '%s', will continue", repo)
+	for root, wc = range currentConfig().GitRepos() {
+		log.Debug().Str("root", root).Msg("discovering repositories in watched directory")
+		if repos, err = discoverRepos(root, wc); err != nil {
+			log.Error().Err(err).Msgf("error encountered while discovering repositories in '%s', will continue", root)
+			continue
+		}
+		for _, repo := range repos {
+			if shuttingDown() {
+				log.Debug().Msg("shutdown requested, skipping remaining repositories")
+				return
+			}
+			if isPaused() {
+				log.Debug().Msg("captures paused, skipping remaining repositories")
+				return
+			}
+			log.Debug().Str("repo", repo).Msg("processing repository")
+			log.Trace().Msgf("calling processDirectory for '%s'", repo)
+			if err = processDirectory(repo, newWatchFilter(wc, watchRelPath(root, repo)), TriggerPoll); err != nil {
+				log.Error().Err(err).Msgf("error encountered while processing '%s', will continue", repo)
+			}
+			log.Trace().Msgf("completed processDirectory for '%s'", repo)
 		}
-		log.Trace().Msgf("completed processDirectory for '%s'", repo)
 	}
 	log.Trace().Msg("leaving repository loop")
 	log.Debug().Msg("processed all repositories")
 	log.Trace().Msg("leaving doTask")
 }
 
+// sleepDuration returns how long the poller sleeps between passes, dura.sleep_seconds or
+// DefSleepSeconds if that is less than 1 second. It is read before every sleep, so a
+// reloaded configuration applies to the next one.
+func sleepDuration() time.Duration {
+	seconds := currentConfig().Dura.SleepSeconds
+	if seconds < 1 {
+		seconds = DefSleepSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func StartPoller() {
 	log.Trace().Msg("entering StartPoller")
-	log.Trace().Msg("loading runtimeLock")
-	if err = runtimeLock.Load(); err != nil {
-		log.Error().Err(err).Msg("error encountered while retrieving runtimeLock")
+	log.Trace().Msg("acquiring runtimeLock")
+	if err = runtimeLock.Acquire(); err != nil {
+		var running *DaemonRunningError
+		if errors.As(err, &running) {
+			log.Fatal().Uint32("pid", running.Pid).Msgf("Shutting down because process %d has runtime lock", running.Pid)
+		}
+		log.Fatal().Err(err).Msg("error encountered while acquiring runtimeLock")
+	}
+	log.Trace().Msg("runtimeLock acquired")
+	startedAt = time.Now()
+	handleSignals()
+	log.Trace().Msg("starting control server")
+	if err = startControlServer(); err != nil {
+		log.Error().Err(err).Msg("error encountered while starting control server, continuing without it")
 	}
-	pid := uint32(os.Getpid())
-	log.Info().Uint32("pid", pid).Msg("current process PID retrieved")
-	runtimeLock.Pid = &pid
-	log.Debug().Uint32("runtimeLock.Pid", pid).Msg("set runtimeLock PID")
-	log.Trace().Msg("saving runtimeLock")
-	if err = runtimeLock.Save(); err != nil {
-		log.Fatal().Err(err).Msg("error encountered while saving runtimeLock")
+	log.Trace().Msg("starting backup worker")
+	go runBackups()
+	settings := currentConfig()
+	log.Trace().Int("config.Dura.SleepSeconds", settings.Dura.SleepSeconds).Msg("checking if configuration contains sleep duration less than 1 second")
+	if settings.Dura.SleepSeconds < 1 {
+		log.Warn().Int("config.Dura.SleepSeconds", settings.Dura.SleepSeconds).Int("default", DefSleepSeconds).Msgf("supplied sleep seconds are less than 1 second, using default value %d", DefSleepSeconds)
 	}
-	log.Trace().Msg("runtimeLock saved")
-	log.Trace().Int("config.Dura.SleepSeconds", config.Dura.SleepSeconds).Msg("checking if configuration contains sleep duration less than 1 second")
-	if config.Dura.SleepSeconds < 1 {
-		log.Warn().Int("config.Dura.SleepSeconds", config.Dura.SleepSeconds).Int("default", DefSleepSeconds).Msgf("supplied sleep seconds are less than 1 second, resetting to default value %d", DefSleepSeconds)
-		config.Dura.SleepSeconds = DefSleepSeconds
-		log.Trace().Int("config.Dura.SleepSeconds", config.Dura.SleepSeconds).Msgf("set config.Dura.SleepSeocnds back to default value (%d)", config.Dura.SleepSeconds)
+	if settings.Dura.Mode == ModeWatch {
+		log.Trace().Int("config.Dura.DebounceMillis", settings.Dura.DebounceMillis).Msg("checking if configuration contains debounce period less than 1 millisecond")
+		if settings.Dura.DebounceMillis < 1 {
+			log.Warn().Int("config.Dura.DebounceMillis", settings.Dura.DebounceMillis).Int("default", DefDebounceMillis).Msgf("supplied debounce period is less than 1 millisecond, using default value %d", DefDebounceMillis)
+		}
+		log.Debug().Msg("begin watching repositories for changes")
+		if err = runWatcher(); err == nil {
+			log.Debug().Msg("file system watcher stopped")
+		} else if errors.Is(err, errWatchLimit) {
+			log.Warn().Err(err).Msg("file system watch limits exhausted, falling back to polling")
+		} else {
+			log.Error().Err(err).Msg("file system watcher stopped, falling back to polling")
+		}
+	} else if settings.Dura.Mode != ModePoll {
+		log.Warn().Str("config.Dura.Mode", settings.Dura.Mode).Msgf("unknown mode, using %s", ModePoll)
 	}
-	log.Debug().Msg("begin processing repositories indefinitely")
-	for {
+	log.Debug().Msg("begin processing repositories until shutdown")
+	for !shuttingDown() {
 		log.Trace().Msg("executing doTask")
 		doTask()
 		log.Trace().Msg("doTask complete")
-		log.Trace().Int("config.Dura.SleepSeconds", config.Dura.SleepSeconds).Msgf("sleeping for %d seconds", config.Dura.SleepSeconds)
-		time.Sleep(time.Duration(config.Dura.SleepSeconds) * time.Second)
-		log.Trace().Msg("waking up")
+		maybePrune()
+		maybeBackup()
+		sleep := sleepDuration()
+		log.Trace().Dur("sleep", sleep).Msgf("sleeping for %s", sleep)
+		select {
+		case <-shutdown:
+		case <-time.After(sleep):
+			log.Trace().Msg("waking up")
+		}
+	}
+	log.Debug().Msg("leaving processing loop, releasing runtimeLock")
+	if err = runtimeLock.Release(); err != nil {
+		log.Error().Err(err).Msg("error encountered while releasing runtimeLock")
 	}
-	log.Panic().Msg("leaving infinite for loop, should never have gotten to this point")
-	log.Panic().Msg("leaving StartPoller, should never have gotten to this point")
+	log.Info().Msg("Dura daemon stopped")
+	log.Trace().Msg("leaving StartPoller")
 }
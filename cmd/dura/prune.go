@@ -0,0 +1,443 @@
+package dura
+
+import (
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// lastPrune is when the daemon last pruned the watched repositories
+var lastPrune time.Time
+
+// PruneOptions configures Prune.
+type PruneOptions struct {
+	// DryRun only decides which snapshots would be removed, no ref is changed
+	DryRun bool
+	// Now is the time the retention rules are applied at, the current time if zero
+	Now time.Time
+}
+
+// PruneResult is the outcome of pruning the Dura refs of a repository.
+type PruneResult struct {
+	Repo string `json:"repo"`
+	// Disabled is true when no retention rule applies to the repository, nothing is pruned
+	Disabled  bool `json:"disabled,omitempty"`
+	Snapshots int  `json:"snapshots"`
+	Kept      int  `json:"kept"`
+	Removed   int  `json:"removed"`
+	// Protected counts the snapshots kept only because they are tagged or a tagged
+	// snapshot descends from them
+	Protected int `json:"protected,omitempty"`
+	// Rewritten are the refs whose snapshot chain was thinned, Deleted those which had no
+	// snapshot left
+	Rewritten []string `json:"rewritten,omitempty"`
+	Deleted   []string `json:"deleted,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// pruneNode is a snapshot considered by Prune.
+type pruneNode struct {
+	commit *git.Commit
+	// older is the hash of the snapshot before this one on its ref, empty for the first
+	older string
+	// base is the hash of the base commit of its ref, empty for unborn branches
+	base string
+}
+
+// retentionFor returns the retention rules of repositories watched with wc, the global
+// rules with the overrides of wc applied.
+func retentionFor(wc WatchConfig) (rc RetentionConfig) {
+	rc = currentConfig().Retention
+	if o := wc.Retention; o != nil {
+		if o.KeepAllHours != nil {
+			rc.KeepAllHours = *o.KeepAllHours
+		}
+		if o.KeepHourly != nil {
+			rc.KeepHourly = *o.KeepHourly
+		}
+		if o.KeepDaily != nil {
+			rc.KeepDaily = *o.KeepDaily
+		}
+		if o.KeepWeekly != nil {
+			rc.KeepWeekly = *o.KeepWeekly
+		}
+	}
+	return
+}
+
+// enabled reports whether any retention rule is set, otherwise every snapshot is kept.
+func (rc RetentionConfig) enabled() bool {
+	return rc.KeepAllHours > 0 || rc.KeepHourly > 0 || rc.KeepDaily > 0 || rc.KeepWeekly > 0
+}
+
+// keep returns the hashes of the snapshots kept by rc at now among nodes. Undated
+// snapshots are always kept.
+func (rc RetentionConfig) keep(nodes map[string]*pruneNode, now time.Time) (kept map[string]bool) {
+	var hashes []string
+	kept = map[string]bool{}
+	for hash, node := range nodes {
+		if undated(node.commit) {
+			kept[hash] = true
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	// Newest first, so the newest snapshot of each period is the one kept
+	sort.Slice(hashes, func(i, j int) bool {
+		ti, tj := nodes[hashes[i]].commit.Committer().When, nodes[hashes[j]].commit.Committer().When
+		if ti.Equal(tj) {
+			return hashes[i] < hashes[j]
+		}
+		return ti.After(tj)
+	})
+	if rc.KeepAllHours > 0 {
+		since := now.Add(-time.Duration(rc.KeepAllHours) * time.Hour)
+		for _, hash := range hashes {
+			if !nodes[hash].commit.Committer().When.Before(since) {
+				kept[hash] = true
+			}
+		}
+	}
+	rules := []struct {
+		n      int
+		period func(t time.Time) string
+	}{
+		{rc.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{rc.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{rc.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+	}
+	for _, rule := range rules {
+		var (
+			last  string
+			count int
+		)
+		for _, hash := range hashes {
+			if count >= rule.n {
+				break
+			}
+			if period := rule.period(nodes[hash].commit.Committer().When.Local()); period != last {
+				kept[hash] = true
+				last = period
+				count++
+			}
+		}
+	}
+	return
+}
+
+// undated reports whether commit has no usable committer time: snapshots taken before
+// Dura recorded the capture time have the epoch (or a zero time), the retention rules
+// would put all of them in one period.
+func undated(commit *git.Commit) bool {
+	return commit.Committer().When.Unix() <= 0
+}
+
+// Prune applies the retention rules of the repository at path to its Dura snapshots.
+// Snapshots which are not kept are dropped from their ref: the kept snapshots are
+// re-created on top of one another (with the same trees, authors and messages) and the
+// refs moved to the new commits, refs left without any snapshot are deleted. Kept
+// snapshots which don't lose any parent keep their hash, so pruning again without new
+// snapshots changes nothing.
+func Prune(path string, opts PruneOptions) (result *PruneResult, err error) {
+	log.Trace().Msg("entered Prune")
+	logger := log.With().Str("path", path).Logger()
+	var repo *git.Repository
+	if repo, err = OpenRepository(path); err != nil {
+		return
+	}
+	result = &PruneResult{Repo: path}
+	rc := retentionFor(currentConfig().WatchConfigFor(repo.Workdir()))
+	if !rc.enabled() {
+		logger.Debug().Msg("no retention rule set, nothing to prune")
+		result.Disabled = true
+		return
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var refs []string
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	var (
+		nodes = map[string]*pruneNode{}
+		tips  = map[string]string{}
+	)
+	for _, ref := range refs {
+		base, newer := refBase(ref), ""
+		if err = walkRef(repo, ref, base, func(commit *git.Commit) error {
+			hash := commit.Id().String()
+			if newer == "" {
+				tips[ref] = hash
+			} else {
+				nodes[newer].older = hash
+			}
+			if _, ok := nodes[hash]; !ok {
+				nodes[hash] = &pruneNode{commit: commit, base: base}
+			}
+			newer = hash
+			return nil
+		}); err != nil {
+			logger.Error().Err(err).Str("ref", ref).Msg("error encountered while reading Dura ref")
+			return
+		}
+	}
+	kept := rc.keep(nodes, now)
+	var tagged map[string]bool
+	if tagged, err = taggedSnapshots(repo); err != nil {
+		logger.Error().Err(err).Msg("error encountered while reading Dura tags")
+		return
+	}
+	for hash := range tagged {
+		result.Protected += protect(nodes, kept, hash)
+	}
+	result.Snapshots, result.Kept, result.Removed = len(nodes), len(kept), len(nodes)-len(kept)
+	logger.Debug().Int("snapshots", result.Snapshots).Int("kept", result.Kept).Msg("retention rules applied")
+
+	p := &pruner{repo: repo, nodes: nodes, kept: kept, dryRun: opts.DryRun, rewritten: map[string]string{}}
+	for _, ref := range refs {
+		tip, ok := tips[ref]
+		if !ok {
+			continue
+		}
+		newTip := p.nearestKept(tip)
+		if newTip != "" {
+			if newTip, err = p.rewrite(newTip); err != nil {
+				logger.Error().Err(err).Str("ref", ref).Msg("error encountered while rewriting Dura ref")
+				return
+			}
+			if newTip == tip {
+				continue
+			}
+		}
+		if !opts.DryRun {
+			if err = p.update(ref, tip, newTip); err != nil {
+				logger.Error().Err(err).Str("ref", ref).Msg("error encountered while updating Dura ref")
+				return
+			}
+		}
+		if newTip == "" {
+			result.Deleted = append(result.Deleted, ref)
+		} else {
+			result.Rewritten = append(result.Rewritten, ref)
+		}
+	}
+	logger.Info().Int("removed", result.Removed).Int("rewritten", len(result.Rewritten)).Int("deleted", len(result.Deleted)).Bool("dryRun", opts.DryRun).Msg("pruned Dura snapshots")
+	log.Trace().Msg("leaving Prune")
+	return
+}
+
+// PruneAll runs Prune on every repository watched, a repository which fails to prune is
+// reported in its result and doesn't stop the others.
+func PruneAll(opts PruneOptions) (results []PruneResult) {
+	log.Trace().Msg("entered PruneAll")
+	for root, wc := range currentConfig().GitRepos() {
+		repos, err := discoverRepos(root, wc)
+		if err != nil {
+			log.Error().Err(err).Msgf("error encountered while discovering repositories in '%s', will continue", root)
+			results = append(results, PruneResult{Repo: root, Error: err.Error()})
+			continue
+		}
+		for _, repo := range repos {
+			result, err := Prune(repo, opts)
+			if result == nil {
+				result = &PruneResult{Repo: repo}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, *result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Repo < results[j].Repo })
+	log.Trace().Msg("leaving PruneAll")
+	return
+}
+
+// maybePrune prunes every watched repository if retention.prune_interval_hours have
+// passed since the daemon last did, it is called from the daemon's capture loop.
+func maybePrune() {
+	interval := time.Duration(currentConfig().Retention.PruneIntervalHours) * time.Hour
+	if interval <= 0 || isPaused() || time.Since(lastPrune) < interval {
+		return
+	}
+	log.Debug().Dur("interval", interval).Msg("pruning watched repositories")
+	lastPrune = time.Now()
+	for _, result := range PruneAll(PruneOptions{}) {
+		if result.Error != "" {
+			log.Error().Str("repo", result.Repo).Str("error", result.Error).Msg("error encountered while pruning, will continue")
+		}
+	}
+}
+
+// protect marks the snapshot hash and every snapshot it descends from as kept, so it is
+// left untouched by the rewrite, and returns how many were not kept already.
+func protect(nodes map[string]*pruneNode, kept map[string]bool, hash string) (count int) {
+	var (
+		pending = []string{hash}
+		visited = map[string]bool{}
+	)
+	for len(pending) > 0 {
+		hash, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		node, ok := nodes[hash]
+		if !ok || visited[hash] {
+			continue
+		}
+		visited[hash] = true
+		if !kept[hash] {
+			kept[hash] = true
+			count++
+		}
+		if node.older != "" {
+			pending = append(pending, node.older)
+		}
+		for i := uint(1); i < node.commit.ParentCount(); i++ {
+			pending = append(pending, node.commit.ParentId(i).String())
+		}
+	}
+	return
+}
+
+// pruner rewrites the snapshot chains of a repository keeping only the kept snapshots.
+type pruner struct {
+	repo   *git.Repository
+	nodes  map[string]*pruneNode
+	kept   map[string]bool
+	dryRun bool
+	// rewritten maps the hash of kept snapshots to the hash of their rewritten commit
+	rewritten map[string]string
+}
+
+// nearestKept returns hash if it is kept, otherwise the newest kept snapshot before it
+// on its ref, or an empty string if there is none.
+func (p *pruner) nearestKept(hash string) string {
+	for hash != "" && !p.kept[hash] {
+		node, ok := p.nodes[hash]
+		if !ok {
+			return ""
+		}
+		hash = node.older
+	}
+	return hash
+}
+
+// rewrite returns the hash of the commit replacing the kept snapshot hash, re-created
+// on top of the kept snapshots before it. Snapshots whose parents are unchanged are
+// reused as they are. In a dry run no commit is created and placeholder hashes are used.
+func (p *pruner) rewrite(hash string) (newHash string, err error) {
+	if newHash, ok := p.rewritten[hash]; ok {
+		return newHash, nil
+	}
+	node := p.nodes[hash]
+	var (
+		parents  []string
+		original []string
+	)
+	for i := uint(0); i < node.commit.ParentCount(); i++ {
+		original = append(original, node.commit.ParentId(i).String())
+	}
+	if older := p.nearestKept(node.older); older != "" {
+		var parent string
+		if parent, err = p.rewrite(older); err != nil {
+			return
+		}
+		parents = append(parents, parent)
+	} else if node.base != "" {
+		parents = append(parents, node.base)
+	}
+	if len(original) > 1 {
+		// The lineage link moves to the newest kept snapshot before the one it pointed to
+		previous := original[1]
+		if _, known := p.nodes[previous]; known {
+			previous = p.nearestKept(previous)
+		}
+		if previous != "" {
+			if p.kept[previous] {
+				if previous, err = p.rewrite(previous); err != nil {
+					return
+				}
+			}
+			parents = append(parents, previous)
+		}
+	}
+	if equalHashes(parents, original) {
+		p.rewritten[hash] = hash
+		return hash, nil
+	}
+	if p.dryRun {
+		newHash = "rewritten-" + hash
+		p.rewritten[hash] = newHash
+		return
+	}
+	var (
+		tree          *git.Tree
+		parentCommits []*git.Commit
+		oid           *git.Oid
+	)
+	if tree, err = node.commit.Tree(); err != nil {
+		return
+	}
+	for _, parent := range parents {
+		var commit *git.Commit
+		if oid, err = git.NewOid(parent); err == nil {
+			commit, err = p.repo.LookupCommit(oid)
+		}
+		if err != nil {
+			return
+		}
+		parentCommits = append(parentCommits, commit)
+	}
+	if oid, err = p.repo.CreateCommit("", node.commit.Author(), node.commit.Committer(), node.commit.RawMessage(), tree, parentCommits...); err != nil {
+		return
+	}
+	newHash = oid.String()
+	p.rewritten[hash] = newHash
+	return
+}
+
+// update moves ref from tip to newTip, or deletes it if newTip is empty. A ref which no
+// longer points to tip (a snapshot was taken meanwhile) is left alone.
+func (p *pruner) update(ref string, tip string, newTip string) (err error) {
+	var (
+		store     *git.Repository
+		reference *git.Reference
+		oid       *git.Oid
+	)
+	if store, err = duraStore(p.repo); err != nil {
+		return
+	}
+	if reference, err = store.References.Lookup(ref); err != nil {
+		return
+	}
+	if reference.Target() == nil || reference.Target().String() != tip {
+		log.Warn().Str("ref", ref).Msg("ref changed while pruning, leaving it for the next run")
+		return
+	}
+	if newTip == "" {
+		return reference.Delete()
+	}
+	if oid, err = git.NewOid(newTip); err != nil {
+		return
+	}
+	_, err = reference.SetTarget(oid, "dura prune")
+	return
+}
+
+func equalHashes(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+package dura
+
+import (
+	git "github.com/libgit2/git2go/v33"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testSnapshot creates a commit in repo holding the tree of HEAD, committed at when with
+// the given parents.
+func testSnapshot(t *testing.T, repo *git.Repository, message string, when time.Time, parents ...*git.Commit) (commit *git.Commit) {
+	t.Helper()
+	var (
+		err  error
+		head *git.Commit
+		tree *git.Tree
+		oid  *git.Oid
+	)
+	if head, err = headPeelToCommit(repo); err != nil {
+		t.Fatalf("unable to read HEAD: %v", err)
+	}
+	if tree, err = head.Tree(); err != nil {
+		t.Fatalf("unable to read tree of HEAD: %v", err)
+	}
+	sig := &git.Signature{Name: "Dura Test", Email: "dura@example.com", When: when}
+	if oid, err = repo.CreateCommit("", sig, sig, message, tree, parents...); err != nil {
+		t.Fatalf("unable to create %s: %v", message, err)
+	}
+	if commit, err = repo.LookupCommit(oid); err != nil {
+		t.Fatalf("unable to look up %s: %v", message, err)
+	}
+	return
+}
+
+// keptNames returns the names of the kept hashes, sorted.
+func keptNames(kept map[string]bool, names map[string]string) (sorted []string) {
+	for hash := range kept {
+		sorted = append(sorted, names[hash])
+	}
+	sort.Strings(sorted)
+	return
+}
+
+func TestRetentionKeep(t *testing.T) {
+	repo := initTestRepo(t, map[string]string{"file.txt": "one\n"})
+	now := time.Date(2022, 3, 10, 12, 0, 0, 0, time.Local)
+	var (
+		nodes = map[string]*pruneNode{}
+		names = map[string]string{}
+	)
+	for name, when := range map[string]time.Time{
+		"a":       now.Add(-10 * time.Minute),
+		"b":       now.Add(-30 * time.Minute),
+		"c":       now.Add(-90 * time.Minute),
+		"d":       now.Add(-26 * time.Hour),
+		"e":       now.Add(-27 * time.Hour),
+		"legacy1": time.Unix(0, 0),
+		"legacy2": time.Unix(0, 0),
+	} {
+		commit := testSnapshot(t, repo, name, when)
+		nodes[commit.Id().String()] = &pruneNode{commit: commit}
+		names[commit.Id().String()] = name
+	}
+
+	tests := []struct {
+		name string
+		rc   RetentionConfig
+		want []string
+	}{
+		{"no rule keeps undated snapshots only", RetentionConfig{}, []string{"legacy1", "legacy2"}},
+		{"keep all hours", RetentionConfig{KeepAllHours: 1}, []string{"a", "b", "legacy1", "legacy2"}},
+		{"keep hourly", RetentionConfig{KeepHourly: 2}, []string{"a", "c", "legacy1", "legacy2"}},
+		{"keep daily", RetentionConfig{KeepDaily: 2}, []string{"a", "d", "legacy1", "legacy2"}},
+		{"keep weekly", RetentionConfig{KeepWeekly: 1}, []string{"a", "legacy1", "legacy2"}},
+		{"rules combine", RetentionConfig{KeepAllHours: 1, KeepDaily: 2}, []string{"a", "b", "d", "legacy1", "legacy2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keptNames(tt.rc.keep(nodes, now), names)
+			if !equalHashes(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testChain holds the snapshots used by the protect and rewrite tests: the ref of base
+// holds s1, s2 and s3, the ref of base2 holds t1, whose lineage parent is s2.
+type testChain struct {
+	repo  *git.Repository
+	base  *git.Commit
+	nodes map[string]*pruneNode
+	names map[string]string
+	ids   map[string]string
+}
+
+func newTestChain(t *testing.T) (c *testChain) {
+	t.Helper()
+	repo := initTestRepo(t, map[string]string{"file.txt": "one\n"})
+	now := time.Now()
+	c = &testChain{repo: repo, nodes: map[string]*pruneNode{}, names: map[string]string{}, ids: map[string]string{}}
+	c.base = testSnapshot(t, repo, "base", now.Add(-time.Hour))
+	base2 := testSnapshot(t, repo, "base2", now.Add(-time.Hour))
+	add := func(name string, older string, base *git.Commit, commit *git.Commit) *git.Commit {
+		hash := commit.Id().String()
+		c.nodes[hash] = &pruneNode{commit: commit, older: c.ids[older], base: base.Id().String()}
+		c.names[hash] = name
+		c.ids[name] = hash
+		return commit
+	}
+	s1 := add("s1", "", c.base, testSnapshot(t, repo, "s1", now.Add(-3*time.Minute), c.base))
+	s2 := add("s2", "s1", c.base, testSnapshot(t, repo, "s2", now.Add(-2*time.Minute), s1))
+	add("s3", "s2", c.base, testSnapshot(t, repo, "s3", now.Add(-time.Minute), s2))
+	add("t1", "", base2, testSnapshot(t, repo, "t1", now, base2, s2))
+	return
+}
+
+func (c *testChain) kept(names ...string) (kept map[string]bool) {
+	kept = map[string]bool{}
+	for _, name := range names {
+		kept[c.ids[name]] = true
+	}
+	return
+}
+
+func TestProtect(t *testing.T) {
+	c := newTestChain(t)
+	tests := []struct {
+		name      string
+		kept      []string
+		tagged    string
+		wantCount int
+		want      []string
+	}{
+		{"tagged snapshot keeps its ref ancestry", nil, "s2", 2, []string{"s1", "s2"}},
+		{"tagged snapshot keeps its lineage ancestry", nil, "t1", 3, []string{"s1", "s2", "t1"}},
+		{"already kept snapshots are not counted", []string{"s1"}, "s3", 2, []string{"s1", "s2", "s3"}},
+		{"unknown snapshots are ignored", []string{"s3"}, "unknown", 0, []string{"s3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept := c.kept(tt.kept...)
+			tagged := c.ids[tt.tagged]
+			if tagged == "" {
+				tagged = tt.tagged
+			}
+			if count := protect(c.nodes, kept, tagged); count != tt.wantCount {
+				t.Errorf("protected %d snapshots, want %d", count, tt.wantCount)
+			}
+			if got := keptNames(kept, c.names); !equalHashes(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrunerRewrite(t *testing.T) {
+	c := newTestChain(t)
+	tests := []struct {
+		name string
+		kept []string
+		tip  string
+		// want is the name of the snapshot the ref keeps, or "rewritten" if it is re-created
+		want string
+	}{
+		{"all kept leaves the ref alone", []string{"s1", "s2", "s3"}, "s3", "s3"},
+		{"dropped tip moves the ref to the nearest kept snapshot", []string{"s1", "s2"}, "s3", "s2"},
+		{"dropped snapshot rewrites the snapshots after it", []string{"s1", "s3"}, "s3", "rewritten"},
+		{"nothing kept deletes the ref", nil, "s3", ""},
+		{"kept lineage parent leaves the ref alone", []string{"s1", "s2", "t1"}, "t1", "t1"},
+		{"dropped lineage parent moves the lineage link", []string{"s1", "t1"}, "t1", "rewritten"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pruner{repo: c.repo, nodes: c.nodes, kept: c.kept(tt.kept...), dryRun: true, rewritten: map[string]string{}}
+			var (
+				got string
+				err error
+			)
+			if got = p.nearestKept(c.ids[tt.tip]); got != "" {
+				if got, err = p.rewrite(got); err != nil {
+					t.Fatalf("rewrite failed: %v", err)
+				}
+			}
+			switch {
+			case tt.want == "rewritten":
+				if got != "rewritten-"+c.ids[tt.tip] {
+					t.Errorf("ref moved to %q, want %s re-created", got, tt.tip)
+				}
+			case got != c.ids[tt.want]:
+				t.Errorf("ref moved to %q (%s), want %s", got, c.names[got], tt.want)
+			}
+		})
+	}
+}
+
+func TestPrunerRewriteCreatesCommits(t *testing.T) {
+	c := newTestChain(t)
+	p := &pruner{repo: c.repo, nodes: c.nodes, kept: c.kept("s1", "s3", "t1"), rewritten: map[string]string{}}
+	var (
+		err     error
+		newHash string
+		oid     *git.Oid
+		commit  *git.Commit
+	)
+	for _, name := range []string{"s3", "t1"} {
+		if newHash, err = p.rewrite(c.ids[name]); err != nil {
+			t.Fatalf("rewrite of %s failed: %v", name, err)
+		}
+		if newHash == c.ids[name] {
+			t.Fatalf("%s was not re-created", name)
+		}
+		if oid, err = git.NewOid(newHash); err == nil {
+			commit, err = c.repo.LookupCommit(oid)
+		}
+		if err != nil {
+			t.Fatalf("unable to look up rewritten %s: %v", name, err)
+		}
+		original := c.nodes[c.ids[name]].commit
+		if commit.Message() != original.Message() || !commit.TreeId().Equal(original.TreeId()) {
+			t.Errorf("rewritten %s lost its message or tree", name)
+		}
+		// Both the older snapshot of s3 and the lineage parent of t1 are now s1
+		if last := commit.ParentId(commit.ParentCount() - 1).String(); last != c.ids["s1"] {
+			t.Errorf("rewritten %s has parent %s, want s1", name, c.names[last])
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package dura
+
+import (
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// LegacyRefNamespace is where Dura refs were always stored before the namespace
+	// became configurable, turning every snapshot ref into a branch
+	LegacyRefNamespace = "refs/heads"
+	// DefRefNamespace is the commit.ref_namespace used when none is configured
+	DefRefNamespace = LegacyRefNamespace
+	// DefRefPattern is the commit.ref_pattern used when none is configured
+	DefRefPattern = "{prefix}/{head}"
+
+	// unbornRefPart stands for {head} in the Dura refs of unborn branches, followed by
+	// the name of the branch
+	unbornRefPart = "unborn"
+)
+
+var (
+	// refPlaceholderRe matches the placeholders of commit.ref_pattern
+	refPlaceholderRe = regexp.MustCompile(`\{(prefix|head|branch|host)\}`)
+	// refUnsafeRe matches runs of characters replaced when expanding placeholders
+	refUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9._/-]+`)
+	// shaRe matches a full commit hash
+	shaRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	// layoutCache holds the regular expressions of refLayouts for the configuration they
+	// were compiled from
+	layoutCache struct {
+		sync.Mutex
+		key     string
+		layouts []*regexp.Regexp
+	}
+)
+
+// refNamespace returns the configured namespace of Dura refs without trailing slashes.
+func refNamespace() string {
+	if ns := strings.TrimRight(currentConfig().Commit.RefNamespace, "/"); ns != "" {
+		return ns
+	}
+	return DefRefNamespace
+}
+
+// refNamespaces returns the namespaces searched for Dura refs: the configured one first,
+// then those it was set to before which may still hold refs.
+func refNamespaces() (namespaces []string) {
+	namespaces = []string{refNamespace()}
+	for _, ns := range currentConfig().Commit.PreviousRefNamespaces {
+		if ns = strings.TrimRight(ns, "/"); ns != "" && !containsString(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return
+}
+
+// refPattern returns the configured naming pattern of the Dura refs in namespace,
+// DefRefPattern if it is unset or lacks the {head} placeholder every Dura ref must
+// contain. In the namespaces git keeps other refs in (branches, tags and remotes) the
+// pattern must start with {prefix} or a fixed part, so no branch of the user can match it.
+func refPattern(namespace string) string {
+	pattern := strings.Trim(currentConfig().Commit.RefPattern, "/")
+	if pattern == "" {
+		return DefRefPattern
+	}
+	if !strings.Contains(pattern, "{head}") {
+		log.Warn().Str("config.Commit.RefPattern", pattern).Msgf("ref pattern lacks {head} placeholder, using %s", DefRefPattern)
+		return DefRefPattern
+	}
+	if sharedRefNamespace(namespace) && strings.HasPrefix(pattern, "{") && !strings.HasPrefix(pattern, "{prefix}") {
+		log.Warn().Str("config.Commit.RefPattern", pattern).Str("namespace", namespace).Msgf("ref pattern must start with {prefix} or a fixed part in %s, using %s", namespace, DefRefPattern)
+		return DefRefPattern
+	}
+	return pattern
+}
+
+// sharedRefNamespace reports whether namespace is, or lies within, one of the namespaces
+// git keeps branches, tags and remote-tracking branches in.
+func sharedRefNamespace(namespace string) bool {
+	for _, shared := range []string{LegacyRefNamespace, "refs/tags", "refs/remotes"} {
+		if namespace == shared || strings.HasPrefix(namespace, shared+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// refFields are the values of the placeholders of a ref pattern.
+type refFields struct {
+	// Prefix is the branch prefix, {prefix}
+	Prefix string
+	// Head is the hash of the base commit, or unbornHead of the branch if there is
+	// none yet, {head}
+	Head string
+	// Branch is the branch checked out, "detached" if none, {branch}
+	Branch string
+	// Host is the hostname, {host}
+	Host string
+}
+
+// duraRefName returns the full name of the Dura ref receiving the snapshots of repo
+// taken on top of head, expanding the placeholders of the configured ref pattern:
+// {prefix} (the branch prefix of wc), {head} (the hash of head), {branch} (the branch
+// checked out, "detached" if none) and {host} (the hostname). A nil head stands for
+// the unborn branch of a repository without commits, {head} is unbornHead(branch).
+func duraRefName(repo *git.Repository, head *git.Commit, wc WatchConfig) (name string, err error) {
+	log.Trace().Msg("entered duraRefName")
+	fields := refFields{
+		Prefix: branchPrefix(wc),
+		Branch: "detached",
+		Host:   hostname(),
+	}
+	if head == nil {
+		fields.Branch = unbornBranch(repo)
+		fields.Head = unbornHead(fields.Branch)
+	} else {
+		fields.Head = head.Id().String()
+		if ref, headErr := repo.Head(); headErr == nil && ref.IsBranch() {
+			fields.Branch = ref.Shorthand()
+		}
+	}
+	namespace := refNamespace()
+	name, err = expandRefName(namespace, refPattern(namespace), fields)
+	log.Trace().Msg("leaving duraRefName")
+	return
+}
+
+// legacyRefName returns the name the Dura ref receiving the snapshots taken on top of
+// head had in the legacy layout, refs/heads/<prefix>/<head>.
+func legacyRefName(head *git.Commit, wc WatchConfig) string {
+	return fmt.Sprintf("%s/%s/%s", LegacyRefNamespace, branchPrefix(wc), head.Id().String())
+}
+
+// expandRefName returns the full name of the ref in namespace named by pattern with
+// fields, an error is returned if the result is not a valid reference name.
+func expandRefName(namespace string, pattern string, fields refFields) (name string, err error) {
+	expanded := refPlaceholderRe.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		switch placeholder {
+		case "{prefix}":
+			return fields.Prefix
+		case "{head}":
+			return fields.Head
+		case "{branch}":
+			return sanitizeRefPart(fields.Branch)
+		default:
+			return sanitizeRefPart(fields.Host)
+		}
+	})
+	name = fmt.Sprintf("%s/%s", namespace, expanded)
+	var valid bool
+	if valid, err = git.ReferenceNameIsValid(name); err != nil || !valid {
+		if err == nil {
+			err = fmt.Errorf("'%s' (from ref pattern '%s') is not a valid reference name", name, pattern)
+		}
+		log.Error().Err(err).Msg("invalid Dura ref name")
+	}
+	return
+}
+
+func sanitizeRefPart(s string) string {
+	return strings.Trim(refUnsafeRe.ReplaceAllString(s, "-"), "-./")
+}
+
+// unbornHead returns the value of {head} in the Dura ref of the unborn branch.
+func unbornHead(branch string) string {
+	return unbornRefPart + "/" + sanitizeRefPart(branch)
+}
+
+// unbornBranch returns the short name of the branch HEAD points to in a repository
+// without commits, "master" if it can't be read.
+func unbornBranch(repo *git.Repository) string {
+	if head, err := repo.References.Lookup("HEAD"); err == nil && head.Type() == git.ReferenceSymbolic {
+		if branch := strings.TrimPrefix(head.SymbolicTarget(), LegacyRefNamespace+"/"); branch != "" {
+			return branch
+		}
+	}
+	return "master"
+}
+
+// hostname returns the sanitized hostname used in ref names, "unknown" if unavailable.
+func hostname() string {
+	host, _ := os.Hostname()
+	if host = sanitizeRefPart(host); host == "" {
+		host = "unknown"
+	}
+	return host
+}
+
+// refGlobs returns the reference globs matching the Dura refs of repositories: those
+// of the configured layout in every namespace of refNamespaces, along with the legacy
+// refs/heads/<prefix>/ branches, for every configured branch prefix.
+func refGlobs() (globs []string) {
+	seen := map[string]bool{}
+	add := func(glob string) {
+		if !seen[glob] {
+			seen[glob] = true
+			globs = append(globs, glob)
+		}
+	}
+	for _, prefix := range currentConfig().BranchPrefixes() {
+		add(fmt.Sprintf("%s/%s/*", LegacyRefNamespace, prefix))
+		for _, namespace := range refNamespaces() {
+			// The configured layout is matched up to its first placeholder other than {prefix}
+			static := strings.Replace(refPattern(namespace), "{prefix}", prefix, -1)
+			if i := strings.Index(static, "{"); i >= 0 {
+				static = static[:i]
+			}
+			add(fmt.Sprintf("%s/%s*", namespace, static))
+		}
+	}
+	return
+}
+
+// refLayouts returns the regular expressions matching the full names of Dura refs, in
+// the configured layout within every namespace of refNamespaces and in the legacy
+// layout, for every configured branch prefix. Their head group is the base commit hash,
+// or unbornHead of the branch.
+func refLayouts() (layouts []*regexp.Regexp) {
+	var (
+		namespaces = refNamespaces()
+		patterns   = map[string]string{}
+		prefixes   = currentConfig().BranchPrefixes()
+		key        = strings.Join(prefixes, "\x00")
+	)
+	for _, namespace := range namespaces {
+		patterns[namespace] = refPattern(namespace)
+		key += "\x00" + namespace + "\x00" + patterns[namespace]
+	}
+	layoutCache.Lock()
+	defer layoutCache.Unlock()
+	if layoutCache.key == key {
+		return layoutCache.layouts
+	}
+	for _, prefix := range prefixes {
+		layouts = append(layouts, regexp.MustCompile("^"+regexp.QuoteMeta(LegacyRefNamespace+"/"+prefix+"/")+`(?P<head>[0-9a-f]{40})$`))
+		for _, namespace := range namespaces {
+			if layout := refLayout(namespace, patterns[namespace], prefix); layout != nil {
+				layouts = append(layouts, layout)
+			}
+		}
+	}
+	layoutCache.key, layoutCache.layouts = key, layouts
+	return
+}
+
+// refLayout returns the regular expression matching the full names of the Dura refs
+// named by pattern within namespace with prefix, nil if it can't be compiled.
+func refLayout(namespace string, pattern string, prefix string) *regexp.Regexp {
+	var (
+		expr string
+		last int
+		head bool
+	)
+	for _, loc := range refPlaceholderRe.FindAllStringIndex(pattern, -1) {
+		expr += regexp.QuoteMeta(pattern[last:loc[0]])
+		switch placeholder := pattern[loc[0]:loc[1]]; {
+		case placeholder == "{prefix}":
+			expr += regexp.QuoteMeta(prefix)
+		case placeholder == "{head}" && !head:
+			expr += `(?P<head>[0-9a-f]{40}|` + unbornRefPart + `/.+)`
+			head = true
+		case placeholder == "{host}":
+			expr += `[^/]+`
+		default:
+			expr += `.+`
+		}
+		last = loc[1]
+	}
+	expr += regexp.QuoteMeta(pattern[last:])
+	layout, err := regexp.Compile("^" + regexp.QuoteMeta(namespace+"/") + expr + "$")
+	if err != nil {
+		log.Error().Err(err).Str("pattern", pattern).Msg("error encountered while compiling ref pattern")
+		return nil
+	}
+	return layout
+}
+
+// refHead returns the {head} part of the Dura ref named ref, ok is false if ref is not
+// named like a Dura ref.
+func refHead(ref string) (head string, ok bool) {
+	for _, layout := range refLayouts() {
+		if m := layout.FindStringSubmatch(ref); m != nil {
+			return m[layout.SubexpIndex("head")], true
+		}
+	}
+	return
+}
+
+// duraRefs returns the full names of every Dura ref of repo, in both the configured and
+// the legacy layout. Only refs named exactly like them, with a full commit hash (the base
+// commit) or the unborn branch part as their {head}, are considered Dura refs.
+func duraRefs(repo *git.Repository) (refs []string, err error) {
+	log.Trace().Msg("entered duraRefs")
+	seen := map[string]bool{}
+	for _, glob := range refGlobs() {
+		if err = eachRef(repo, glob, func(ref *git.Reference) {
+			if name := ref.Name(); !seen[name] {
+				if _, ok := refHead(name); !ok {
+					return
+				}
+				seen[name] = true
+				refs = append(refs, name)
+			}
+		}); err != nil {
+			log.Error().Err(err).Str("glob", glob).Msg("error encountered while iterating Dura refs")
+			return
+		}
+	}
+	sort.Strings(refs)
+	log.Trace().Msg("leaving duraRefs")
+	return
+}
+
+// eachRef calls fn for every reference matching glob of the repository holding the Dura
+// refs of repo (see duraStore).
+func eachRef(repo *git.Repository, glob string, fn func(ref *git.Reference)) (err error) {
+	if repo, err = duraStore(repo); err != nil {
+		return
+	}
+	return eachRefOf(repo, glob, fn)
+}
+
+// eachRefOf calls fn for every reference matching glob of repo itself.
+func eachRefOf(repo *git.Repository, glob string, fn func(ref *git.Reference)) (err error) {
+	var (
+		iter *git.ReferenceIterator
+		ref  *git.Reference
+	)
+	if iter, err = repo.NewReferenceIteratorGlob(glob); err != nil {
+		return
+	}
+	defer iter.Free()
+	for {
+		if ref, err = iter.Next(); err != nil {
+			if git.IsErrorCode(err, git.ErrorCodeIterOver) {
+				err = nil
+			}
+			return
+		}
+		fn(ref)
+	}
+}
+
+// refBase returns the base commit hash encoded in the name of a Dura ref, its {head},
+// or an empty string if there is none (the Dura refs of unborn branches have no base
+// commit). For refs not in a known layout, the last component which is a full commit
+// hash is returned.
+func refBase(ref string) string {
+	if head, ok := refHead(ref); ok {
+		if shaRe.MatchString(head) {
+			return head
+		}
+		return ""
+	}
+	parts := strings.Split(ref, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if shaRe.MatchString(parts[i]) {
+			return parts[i]
+		}
+	}
+	return ""
+}
+
+// shortRef returns ref without the refs/heads/ prefix of branches, other refs are left
+// untouched so they can't be mistaken for branches.
+func shortRef(ref string) string {
+	return strings.TrimPrefix(ref, LegacyRefNamespace+"/")
+}
+
+// lookupRefCommit returns the commit the Dura ref (or any ref of the repository holding
+// the Dura refs, see duraStore) points to, nil if ref doesn't exist.
+func lookupRefCommit(repo *git.Repository, ref string) (commit *git.Commit, err error) {
+	log.Trace().Msg("entered lookupRefCommit")
+	if repo, err = duraStore(repo); err != nil {
+		return
+	}
+	logger := log.With().Str("repo", repo.Path()).Str("ref", ref).Logger()
+	var (
+		reference *git.Reference
+		obj       *git.Object
+	)
+	if reference, err = repo.References.Lookup(ref); err != nil {
+		if git.IsErrorCode(err, git.ErrorCodeNotFound) {
+			logger.Debug().Msg("ref does not exist")
+			err = nil
+			return
+		}
+		logger.Error().Err(err).Msg("error encountered while looking up ref")
+		return
+	}
+	if obj, err = reference.Peel(git.ObjectCommit); err != nil {
+		logger.Error().Err(err).Msg("error encountered while peeling ref to commit")
+		return
+	}
+	if commit, err = obj.AsCommit(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while casting object to git.Commit")
+		return
+	}
+	log.Trace().Msg("leaving lookupRefCommit")
+	return
+}
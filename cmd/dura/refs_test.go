@@ -0,0 +1,58 @@
+package dura
+
+import (
+	"strings"
+	"testing"
+)
+
+// withCommitConfig runs fn with the commit settings of the configuration set to commit.
+func withCommitConfig(t *testing.T, commit CommitConfig, fn func()) {
+	t.Helper()
+	configLock.Lock()
+	saved := config
+	config.Commit = commit
+	configLock.Unlock()
+	defer func() {
+		configLock.Lock()
+		config = saved
+		configLock.Unlock()
+	}()
+	fn()
+}
+
+func TestRefHead(t *testing.T) {
+	sha := strings.Repeat("0123456789", 4)
+	tests := []struct {
+		name      string
+		namespace string
+		pattern   string
+		ref       string
+		wantHead  string
+		wantOk    bool
+	}{
+		{"default layout", "", "", "refs/heads/dura/" + sha, sha, true},
+		{"default layout unborn", "", "", "refs/heads/dura/unborn/main", "unborn/main", true},
+		{"default layout ignores other branches", "", "", "refs/heads/feature/" + sha, "", false},
+		{"default layout ignores trailing parts", "", "", "refs/heads/dura/" + sha + "/x", "", false},
+		{"leading placeholder rejected in branches", "refs/heads", "{branch}/{head}", "refs/heads/feature/" + sha, "", false},
+		{"leading placeholder rejected in branches keeps unborn branches out", "refs/heads", "{branch}/{head}", "refs/heads/feature/unborn/x", "", false},
+		{"leading placeholder rejected falls back to default", "refs/heads", "{branch}/{head}", "refs/heads/dura/" + sha, sha, true},
+		{"own namespace allows leading placeholders", "refs/dura", "{host}/{branch}/{head}", "refs/dura/box/feature/x/" + sha, sha, true},
+		{"own namespace unborn", "refs/dura", "{host}/{branch}/{head}", "refs/dura/box/main/unborn/main", "unborn/main", true},
+		{"head not last", "refs/dura", "{prefix}/{head}/{host}", "refs/dura/dura/" + sha + "/box", sha, true},
+		{"previous namespaces are matched", "refs/dura", "", "refs/old/dura/" + sha, "", false},
+		{"legacy layout is still matched", "refs/dura", "{host}/{branch}/{head}", "refs/heads/dura/" + sha, sha, true},
+		{"other prefixes are not matched", "refs/dura", "{prefix}/{branch}/{head}", "refs/dura/other/main/" + sha, "", false},
+		{"unborn part only matched as head", "refs/dura", "{prefix}/{branch}/{head}", "refs/dura/dura/unborn/x", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCommitConfig(t, CommitConfig{RefNamespace: tt.namespace, RefPattern: tt.pattern}, func() {
+				head, ok := refHead(tt.ref)
+				if head != tt.wantHead || ok != tt.wantOk {
+					t.Errorf("refHead(%q) = %q, %v, want %q, %v", tt.ref, head, ok, tt.wantHead, tt.wantOk)
+				}
+			})
+		})
+	}
+}
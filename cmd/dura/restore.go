@@ -0,0 +1,267 @@
+package dura
+
+import (
+	"errors"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RestoreOptions controls how Restore writes files.
+type RestoreOptions struct {
+	// To is the directory files are extracted to, the working directory if empty
+	To string
+	// Force overwrites files whose content would otherwise be lost
+	Force bool
+}
+
+// RestoredFile is a file written (or found to be up to date) by Restore.
+type RestoredFile struct {
+	Path      string `json:"path"`
+	Dest      string `json:"dest"`
+	Unchanged bool   `json:"unchanged"`
+}
+
+// restoreEntry is a blob of the snapshot tree selected for restoring.
+type restoreEntry struct {
+	path string
+	id   *git.Oid
+	mode git.Filemode
+}
+
+// UnsavedChangesError is returned by Restore when restoring would overwrite files whose
+// content is not stored anywhere in the repository.
+type UnsavedChangesError struct {
+	Files []string
+}
+
+func (e *UnsavedChangesError) Error() string {
+	return fmt.Sprintf("refusing to overwrite unsaved changes to %s (use --force to overwrite)", strings.Join(e.Files, ", "))
+}
+
+// Restore writes the versions of paths (relative to the repository root, an empty path
+// selects every file) stored in snapshot to the working directory of repo, or to
+// opts.To. Directories are restored recursively. Nothing is written if any file would
+// be overwritten while its current content is not saved anywhere in the repository
+// (committed or captured), or, when extracting elsewhere, while it differs from the
+// snapshot version, unless opts.Force is set.
+func Restore(repo *git.Repository, snapshot *git.Commit, paths []string, opts RestoreOptions) (restored []RestoredFile, err error) {
+	log.Trace().Msg("entered Restore")
+	logger := log.With().Str("repo", repo.Path()).Str("snapshot", snapshot.Id().String()).Logger()
+	var (
+		tree    *git.Tree
+		odb     *git.Odb
+		entries []restoreEntry
+		dest    = opts.To
+		unsaved []string
+		saved   map[string]bool
+	)
+	if dest == "" {
+		if dest = repo.Workdir(); dest == "" {
+			err = errors.New("repository has no working directory")
+			return
+		}
+	}
+	if tree, err = snapshot.Tree(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while retrieving snapshot tree")
+		return
+	}
+	if odb, err = repo.Odb(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while opening object database")
+		return
+	}
+	for _, p := range paths {
+		var selected []restoreEntry
+		if selected, err = selectEntries(tree, p); err != nil {
+			logger.Error().Err(err).Str("path", p).Msg("error encountered while selecting files to restore")
+			return
+		}
+		entries = append(entries, selected...)
+	}
+
+	logger.Trace().Int("files", len(entries)).Msg("checking for content that would be lost")
+	for _, entry := range entries {
+		file := RestoredFile{Path: entry.path, Dest: filepath.Join(dest, filepath.FromSlash(entry.path))}
+		var current *git.Oid
+		if current, err = hashFile(odb, file.Dest); err != nil {
+			logger.Error().Err(err).Str("file", file.Dest).Msg("error encountered while reading current file")
+			return
+		}
+		if current != nil && current.Equal(entry.id) {
+			file.Unchanged = true
+		} else if current != nil && !opts.Force && (opts.To != "" || !odb.Exists(current)) {
+			// Blobs are stored after clean filters (autocrlf, text attributes, filter
+			// drivers), the file is compared to the staged and captured versions as such
+			if opts.To == "" && saved == nil {
+				if saved, err = savedFiles(repo, entries); err != nil {
+					logger.Error().Err(err).Msg("error encountered while comparing files to their staged and captured versions")
+					return
+				}
+			}
+			if !saved[entry.path] {
+				unsaved = append(unsaved, entry.path)
+			}
+		}
+		restored = append(restored, file)
+	}
+	if len(unsaved) > 0 {
+		err = &UnsavedChangesError{Files: unsaved}
+		logger.Warn().Err(err).Msg("not restoring")
+		return
+	}
+
+	for i, entry := range entries {
+		if restored[i].Unchanged {
+			continue
+		}
+		logger.Debug().Str("file", entry.path).Str("dest", restored[i].Dest).Msg("restoring file")
+		if err = writeBlob(repo, entry, restored[i].Dest); err != nil {
+			logger.Error().Err(err).Str("file", restored[i].Dest).Msg("error encountered while restoring file")
+			return
+		}
+	}
+	logger.Info().Int("files", len(restored)).Msg("restored snapshot files")
+	log.Trace().Msg("leaving Restore")
+	return
+}
+
+// selectEntries returns the blob at p in tree, or every blob below it if p is a tree.
+func selectEntries(tree *git.Tree, p string) (entries []restoreEntry, err error) {
+	p = strings.Trim(p, "/")
+	if p != "" {
+		var entry *git.TreeEntry
+		if entry, err = tree.EntryByPath(p); err != nil {
+			err = fmt.Errorf("%s does not exist in the snapshot", p)
+			return
+		}
+		if entry.Type != git.ObjectTree {
+			entries = append(entries, restoreEntry{path: p, id: entry.Id, mode: entry.Filemode})
+			return
+		}
+		var sub *git.Tree
+		if sub, err = tree.Owner().LookupTree(entry.Id); err != nil {
+			return
+		}
+		tree = sub
+	}
+	err = tree.Walk(func(root string, entry *git.TreeEntry) error {
+		if entry.Type == git.ObjectBlob {
+			entries = append(entries, restoreEntry{path: path.Join(p, root, entry.Name), id: entry.Id, mode: entry.Filemode})
+		}
+		return nil
+	})
+	return
+}
+
+// hashFile returns the blob id of the file (or symbolic link) at name, nil if it doesn't
+// exist.
+func hashFile(odb *git.Odb, name string) (id *git.Oid, err error) {
+	var (
+		fileInfo os.FileInfo
+		data     []byte
+	)
+	if fileInfo, err = os.Lstat(name); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(name); err != nil {
+			return
+		}
+		data = []byte(target)
+	case fileInfo.IsDir():
+		err = fmt.Errorf("%s is a directory", name)
+		return
+	default:
+		if data, err = ioutil.ReadFile(name); err != nil {
+			return
+		}
+	}
+	return odb.Hash(data, git.ObjectBlob)
+}
+
+// savedFiles returns the paths of entries whose working tree file holds, after clean
+// filters, the content staged in the index of repo or that of the newest snapshot.
+func savedFiles(repo *git.Repository, entries []restoreEntry) (saved map[string]bool, err error) {
+	var (
+		index  *git.Index
+		latest *git.Commit
+		tree   *git.Tree
+		opts   git.DiffOptions
+	)
+	if opts, err = git.DefaultDiffOptions(); err != nil {
+		return
+	}
+	opts.Flags = git.DiffIncludeUntracked | git.DiffRecurseUntracked | git.DiffIncludeIgnored | git.DiffRecurseIgnoredDirs | git.DiffIncludeTypeChange | git.DiffDisablePathspecMatch
+	for _, entry := range entries {
+		opts.Pathspec = append(opts.Pathspec, entry.path)
+	}
+	// changed returns the paths diff finds in the working tree which don't match
+	changed := func(diff *git.Diff, err error) (paths map[string]bool, _ error) {
+		if err != nil {
+			return nil, err
+		}
+		defer diff.Free()
+		paths = map[string]bool{}
+		err = diff.ForEach(func(delta git.DiffDelta, progress float64) (git.DiffForEachHunkCallback, error) {
+			paths[delta.NewFile.Path] = true
+			return nil, nil
+		}, git.DiffDetailFiles)
+		return paths, err
+	}
+	var staged, captured map[string]bool
+	if index, err = repo.Index(); err != nil {
+		return
+	}
+	defer index.Free()
+	if staged, err = changed(repo.DiffIndexToWorkdir(index, &opts)); err != nil {
+		return
+	}
+	if latest, err = latestTip(repo, ""); err != nil {
+		return
+	}
+	if latest != nil {
+		if tree, err = latest.Tree(); err != nil {
+			return
+		}
+		if captured, err = changed(repo.DiffTreeToWorkdir(tree, &opts)); err != nil {
+			return
+		}
+	}
+	saved = map[string]bool{}
+	for _, entry := range entries {
+		saved[entry.path] = !staged[entry.path] || (latest != nil && !captured[entry.path])
+	}
+	return
+}
+
+// writeBlob writes the blob of entry to name, creating any missing parent directories.
+func writeBlob(repo *git.Repository, entry restoreEntry, name string) (err error) {
+	var blob *git.Blob
+	if blob, err = repo.LookupBlob(entry.id); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return
+	}
+	if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if entry.mode == git.FilemodeLink {
+		return os.Symlink(string(blob.Contents()), name)
+	}
+	var perm os.FileMode = 0644
+	if entry.mode == git.FilemodeBlobExecutable {
+		perm = 0755
+	}
+	return ioutil.WriteFile(name, blob.Contents(), perm)
+}
@@ -0,0 +1,237 @@
+package dura
+
+import (
+	"errors"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the absolute time formats accepted by ParseTime, interpreted in the
+// local time zone unless they carry an offset.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// clockLayouts are the times of day accepted after "today" and "yesterday", or on their own.
+var clockLayouts = []string{
+	"15:04:05",
+	"15:04",
+	"3:04pm",
+	"3pm",
+}
+
+var (
+	// relativeRe matches relative times such as "15m ago", "2 hours ago" or "1 day"
+	relativeRe = regexp.MustCompile(`^(\d+)\s*([a-z]+)(?:\s+ago)?$`)
+	// branchRe matches the branch@{time} selector syntax
+	branchRe = regexp.MustCompile(`^(.*)@\{(.+)\}$`)
+	// relativeUnits maps the units accepted in relative times to their duration
+	relativeUnits = map[string]time.Duration{
+		"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+		"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+		"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+		"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	}
+)
+
+// ParseTime parses the time expressions shared by every command selecting snapshots by
+// time, relative to now:
+//
+//   - "now", "today" and "yesterday", the latter two optionally followed by a time of day
+//     ("yesterday 14:00"), as well as a time of day on its own ("14:00", today)
+//   - relative times such as "15m ago", "2 hours ago", "1 day" or Go durations ("1h30m")
+//   - absolute timestamps in one of the timeLayouts, in the local time zone unless they
+//     carry an offset, or Unix timestamps prefixed with @ ("@1646140800")
+func ParseTime(s string, now time.Time) (t time.Time, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		err = errors.New("empty time expression")
+		return
+	}
+	if s == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(s, "@") {
+		var unix int64
+		if unix, err = strconv.ParseInt(s[1:], 10, 64); err == nil {
+			return time.Unix(unix, 0), nil
+		}
+	}
+	for _, layout := range timeLayouts {
+		if t, err = time.ParseInLocation(layout, strings.ToUpper(s), time.Local); err == nil {
+			return
+		}
+	}
+	if t, err = parseDay(s, now); err == nil {
+		return
+	}
+	if m := relativeRe.FindStringSubmatch(s); m != nil {
+		if unit, ok := relativeUnits[m[2]]; ok {
+			n, _ := strconv.Atoi(m[1])
+			return now.Add(-time.Duration(n) * unit), nil
+		}
+	}
+	var d time.Duration
+	if d, err = time.ParseDuration(strings.TrimSpace(strings.TrimSuffix(s, "ago"))); err == nil {
+		return now.Add(-d), nil
+	}
+	err = fmt.Errorf("unable to parse time %q", s)
+	return
+}
+
+// parseDay parses "today" and "yesterday", optionally followed by a time of day, or a
+// time of day on its own.
+func parseDay(s string, now time.Time) (t time.Time, err error) {
+	y, mo, d := now.Date()
+	day := time.Date(y, mo, d, 0, 0, 0, 0, now.Location())
+	clock := s
+	for name, offset := range map[string]int{"today": 0, "yesterday": -1} {
+		if strings.HasPrefix(s, name) {
+			day = day.AddDate(0, 0, offset)
+			if clock = strings.TrimSpace(strings.TrimPrefix(s, name)); clock == "" {
+				return day, nil
+			}
+		}
+	}
+	for _, layout := range clockLayouts {
+		var c time.Time
+		if c, err = time.Parse(layout, clock); err == nil {
+			return day.Add(time.Duration(c.Hour())*time.Hour + time.Duration(c.Minute())*time.Minute + time.Duration(c.Second())*time.Second), nil
+		}
+	}
+	err = fmt.Errorf("unable to parse day %q", s)
+	return
+}
+
+// Selector is a parsed snapshot selector, see ParseSelector.
+type Selector struct {
+	// Hash is a (possibly abbreviated) commit hash, when set the other fields are unused
+	Hash string
+	// Branch restricts the snapshots considered, it is either a Dura ref or a revision
+	// whose commit is the base of the Dura refs considered, empty for all refs
+	Branch string
+	// Time selects the newest snapshot taken at or before it
+	Time time.Time
+}
+
+// ParseSelector parses the snapshot selector grammar shared by every command taking a
+// snapshot:
+//
+//   - a time expression accepted by ParseTime, selecting the newest snapshot across all
+//     Dura refs taken at or before that time
+//   - a (possibly abbreviated) commit hash which isn't also a time expression (such as
+//     "100d" or "2022")
+//   - branch@{time}, selecting the newest snapshot taken at or before time on the Dura
+//     ref named branch (in full or any trailing part of it, such as dura/<hash> or just
+//     <hash>), or on the Dura refs based on the commit branch (any revision, HEAD
+//     included) points to. @{time} alone is the same as time.
+func ParseSelector(s string, now time.Time) (sel *Selector, err error) {
+	log.Trace().Msg("entered ParseSelector")
+	s = strings.TrimSpace(s)
+	sel = &Selector{}
+	if m := branchRe.FindStringSubmatch(s); m != nil {
+		sel.Branch = m[1]
+		if sel.Time, err = ParseTime(m[2], now); err != nil {
+			sel = nil
+		}
+		return
+	}
+	if sel.Time, err = ParseTime(s, now); err == nil {
+		return
+	}
+	err = nil
+	if isHex(s) {
+		sel.Hash = s
+		return
+	}
+	err = fmt.Errorf("%q is neither a commit hash nor a time expression", s)
+	sel = nil
+	log.Trace().Msg("leaving ParseSelector")
+	return
+}
+
+// Resolve returns the snapshot commit of repo selected by sel.
+func (sel *Selector) Resolve(repo *git.Repository) (commit *git.Commit, err error) {
+	log.Trace().Msg("entered Selector.Resolve")
+	logger := log.With().Str("repo", repo.Path()).Str("hash", sel.Hash).Str("branch", sel.Branch).Time("time", sel.Time).Logger()
+	if sel.Hash != "" {
+		var obj *git.Object
+		if obj, err = repo.RevparseSingle(sel.Hash); err != nil {
+			logger.Error().Err(err).Msg("error encountered while looking up snapshot")
+			return
+		}
+		return obj.AsCommit()
+	}
+	var match func(branch string) bool
+	if match, err = sel.branchMatcher(repo); err != nil {
+		logger.Error().Err(err).Msg("error encountered while resolving selector branch")
+		return
+	}
+	if commit, err = latestSnapshot(repo, sel.Time, match); err != nil {
+		return
+	}
+	logger.Debug().Str("commit", commit.Id().String()).Msg("resolved snapshot")
+	log.Trace().Msg("leaving Selector.Resolve")
+	return
+}
+
+// branchMatcher returns a predicate reporting whether a Dura ref is considered by sel.
+func (sel *Selector) branchMatcher(repo *git.Repository) (match func(ref string) bool, err error) {
+	if sel.Branch == "" {
+		return func(string) bool { return true }, nil
+	}
+	var refs []string
+	if refs, err = duraRefs(repo); err != nil {
+		return
+	}
+	for _, ref := range refs {
+		if ref == sel.Branch || strings.HasSuffix(ref, "/"+sel.Branch) {
+			name := ref
+			return func(ref string) bool { return ref == name }, nil
+		}
+	}
+	var obj *git.Object
+	if obj, err = repo.RevparseSingle(sel.Branch); err != nil {
+		err = fmt.Errorf("%s is neither a Dura ref nor a revision", sel.Branch)
+		return
+	}
+	if obj, err = obj.Peel(git.ObjectCommit); err != nil {
+		return
+	}
+	base := obj.Id().String()
+	return func(ref string) bool { return refBase(ref) == base }, nil
+}
+
+// ResolveSnapshot parses at with ParseSelector and resolves it to a snapshot of repo.
+func ResolveSnapshot(repo *git.Repository, at string, now time.Time) (commit *git.Commit, err error) {
+	var sel *Selector
+	if sel, err = ParseSelector(at, now); err != nil {
+		return
+	}
+	return sel.Resolve(repo)
+}
+
+func isHex(s string) bool {
+	if len(s) < 4 || len(s) > 40 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package dura
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2022, 3, 10, 15, 30, 0, 0, time.Local)
+	tests := []struct {
+		expr    string
+		want    time.Time
+		wantErr bool
+	}{
+		{expr: "now", want: now},
+		{expr: " NOW ", want: now},
+		{expr: "today", want: time.Date(2022, 3, 10, 0, 0, 0, 0, time.Local)},
+		{expr: "yesterday", want: time.Date(2022, 3, 9, 0, 0, 0, 0, time.Local)},
+		{expr: "yesterday 14:00", want: time.Date(2022, 3, 9, 14, 0, 0, 0, time.Local)},
+		{expr: "today 9:05am", want: time.Date(2022, 3, 10, 9, 5, 0, 0, time.Local)},
+		{expr: "14:00", want: time.Date(2022, 3, 10, 14, 0, 0, 0, time.Local)},
+		{expr: "2pm", want: time.Date(2022, 3, 10, 14, 0, 0, 0, time.Local)},
+		{expr: "15m ago", want: now.Add(-15 * time.Minute)},
+		{expr: "2 hours ago", want: now.Add(-2 * time.Hour)},
+		{expr: "1 day", want: now.Add(-24 * time.Hour)},
+		{expr: "100d", want: now.Add(-100 * 24 * time.Hour)},
+		{expr: "365d", want: now.Add(-365 * 24 * time.Hour)},
+		{expr: "2w", want: now.Add(-14 * 24 * time.Hour)},
+		{expr: "1h30m", want: now.Add(-90 * time.Minute)},
+		{expr: "1h30m ago", want: now.Add(-90 * time.Minute)},
+		{expr: "2022-03-01", want: time.Date(2022, 3, 1, 0, 0, 0, 0, time.Local)},
+		{expr: "2022-03-01 14:00", want: time.Date(2022, 3, 1, 14, 0, 0, 0, time.Local)},
+		{expr: "2022-03-01T14:00:30", want: time.Date(2022, 3, 1, 14, 0, 30, 0, time.Local)},
+		{expr: "2022-03-01T14:00:00+01:00", want: time.Date(2022, 3, 1, 13, 0, 0, 0, time.UTC)},
+		{expr: "2022-03", want: time.Date(2022, 3, 1, 0, 0, 0, 0, time.Local)},
+		{expr: "2022", want: time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)},
+		{expr: "@1646140800", want: time.Unix(1646140800, 0)},
+		{expr: "", wantErr: true},
+		{expr: "soon", wantErr: true},
+		{expr: "5 fortnights", wantErr: true},
+		{expr: "deadbeef", wantErr: true},
+		{expr: "@later", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := ParseTime(tt.expr, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseTime(%q) = %v, want an error", tt.expr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTime(%q) failed: %v", tt.expr, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseTime(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	now := time.Date(2022, 3, 10, 15, 30, 0, 0, time.Local)
+	tests := []struct {
+		expr    string
+		want    Selector
+		wantErr bool
+	}{
+		{expr: "deadbeef", want: Selector{Hash: "deadbeef"}},
+		{expr: "ABC1234", want: Selector{Hash: "ABC1234"}},
+		{expr: "0123456789abcdef0123456789abcdef01234567", want: Selector{Hash: "0123456789abcdef0123456789abcdef01234567"}},
+		{expr: "100d", want: Selector{Time: now.Add(-100 * 24 * time.Hour)}},
+		{expr: "2022", want: Selector{Time: time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)}},
+		{expr: "15m ago", want: Selector{Time: now.Add(-15 * time.Minute)}},
+		{expr: "main@{yesterday}", want: Selector{Branch: "main", Time: time.Date(2022, 3, 9, 0, 0, 0, 0, time.Local)}},
+		{expr: "dura/abc123@{1h}", want: Selector{Branch: "dura/abc123", Time: now.Add(-time.Hour)}},
+		{expr: "HEAD@{100d}", want: Selector{Branch: "HEAD", Time: now.Add(-100 * 24 * time.Hour)}},
+		{expr: "@{now}", want: Selector{Time: now}},
+		{expr: "main@{soon}", wantErr: true},
+		{expr: "abc", wantErr: true},
+		{expr: "not a selector", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := ParseSelector(tt.expr, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseSelector(%q) = %+v, want an error", tt.expr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector(%q) failed: %v", tt.expr, err)
+			}
+			if got.Hash != tt.want.Hash || got.Branch != tt.want.Branch || !got.Time.Equal(tt.want.Time) {
+				t.Errorf("ParseSelector(%q) = %+v, want %+v", tt.expr, *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package dura
+
+import (
+	"crypto/sha1"
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// shadowDirName is the directory beneath the Dura cache directory holding the shadow
+	// repositories
+	shadowDirName = "shadow"
+	// shadowPriority puts the objects of the shadow repository ahead of the default
+	// backends (loose objects 1, packs 2), so the objects Dura writes land in it
+	shadowPriority = 3
+)
+
+// shadowCache holds the shadow repositories opened by openShadow, by git directory of
+// the repository they shadow
+var shadowCache = struct {
+	sync.Mutex
+	repos map[string]*git.Repository
+}{repos: map[string]*git.Repository{}}
+
+// shadowed reports whether the snapshots of the repository with working directory
+// workdir are kept in a shadow repository, see WatchConfig.Shadow and CommitConfig.Shadow.
+func shadowed(workdir string) bool {
+	if workdir == "" {
+		return false
+	}
+	settings := currentConfig()
+	if wc := settings.WatchConfigFor(workdir); wc.Shadow != nil {
+		return *wc.Shadow
+	}
+	return settings.Commit.Shadow
+}
+
+// ShadowPath returns the path of the shadow repository of repo, a bare repository in the
+// Dura cache directory named after its working directory and the hash of its git
+// directory (shared by all its linked worktrees).
+func ShadowPath(repo *git.Repository) (path string, err error) {
+	var common string
+	if common, err = repo.ItemPath(git.RepositoryItemCommonDir); err != nil {
+		return
+	}
+	if common, err = filepath.Abs(common); err != nil {
+		return
+	}
+	name := sanitizeRefPart(filepath.Base(strings.TrimRight(repo.Workdir(), `/\`)))
+	if name == "" {
+		name = "repo"
+	}
+	sum := sha1.Sum([]byte(filepath.Clean(common)))
+	path = filepath.Join(cacheHome, shadowDirName, fmt.Sprintf("%s-%x.git", name, sum[:6]))
+	return
+}
+
+// openShadow opens the shadow repository of repo, creating it on first use. The shadow
+// repository borrows the objects of repo through its alternates, which lets git read
+// it, but it doesn't rely on them: keepInShadow copies every object its snapshots
+// reference. The shadow repository is opened once per process, when the Dura refs left
+// in repo are moved into it (see adoptRefs).
+func openShadow(repo *git.Repository) (shadow *git.Repository, err error) {
+	log.Trace().Msg("entered openShadow")
+	shadowCache.Lock()
+	defer shadowCache.Unlock()
+	if shadow = shadowCache.repos[repo.Path()]; shadow != nil {
+		// The cache directory may have been removed meanwhile
+		if _, statErr := os.Stat(shadow.Path()); statErr == nil {
+			return
+		}
+	}
+	var (
+		path    string
+		objects string
+	)
+	if path, err = ShadowPath(repo); err != nil {
+		return
+	}
+	logger := log.With().Str("repo", repo.Path()).Str("shadow", path).Logger()
+	if objects, err = repo.ItemPath(git.RepositoryItemObjects); err != nil {
+		return
+	}
+	if objects, err = filepath.Abs(objects); err != nil {
+		return
+	}
+	if shadow, err = git.OpenRepository(path); err != nil {
+		logger.Debug().Msg("creating shadow repository")
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			logger.Error().Err(err).Msg("error encountered while creating shadow directory")
+			return
+		}
+		if shadow, err = git.InitRepository(path, true); err != nil {
+			logger.Error().Err(err).Msg("error encountered while creating shadow repository")
+			return
+		}
+	}
+	// The alternates are rewritten whenever they differ, e.g. after the repository moved
+	alternates := filepath.Join(path, "objects", "info", "alternates")
+	if data, readErr := ioutil.ReadFile(alternates); readErr != nil || strings.TrimSpace(string(data)) != objects {
+		if err = os.MkdirAll(filepath.Dir(alternates), 0755); err == nil {
+			err = ioutil.WriteFile(alternates, []byte(objects+"\n"), os.FileMode(fileMode))
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("error encountered while writing shadow repository alternates")
+			return
+		}
+		if shadow, err = git.OpenRepository(path); err != nil {
+			return
+		}
+	}
+	if _, adoptErr := adoptRefs(repo, shadow); adoptErr != nil {
+		logger.Error().Err(adoptErr).Msg("error encountered while moving Dura refs into shadow repository, will continue")
+	}
+	shadowCache.repos[repo.Path()] = shadow
+	log.Trace().Msg("leaving openShadow")
+	return
+}
+
+// adoptRefs moves into shadow the Dura refs, tags, archives and backup leases of repo,
+// left there from before it was shadowed, so Dura keeps reading them. The snapshots they
+// reach are copied to shadow along with their base commits (see keepInShadow), the
+// history of the branches of repo is only borrowed. A ref which shadow already holds
+// pointing to another commit is left in repo.
+func adoptRefs(repo *git.Repository, shadow *git.Repository) (moved int, err error) {
+	log.Trace().Msg("entered adoptRefs")
+	logger := log.With().Str("repo", repo.Path()).Str("shadow", shadow.Path()).Logger()
+	var (
+		refs  []*git.Reference
+		bases []*git.Oid
+		walk  *git.RevWalk
+		known *git.Tree
+	)
+	// The Dura ref globs also match the other refs sharing their namespace
+	seen := map[string]bool{}
+	collect := func(glob string, duraOnly bool) (err error) {
+		if err = eachRefOf(repo, glob, func(ref *git.Reference) {
+			if _, ok := refHead(ref.Name()); ref.Target() != nil && !seen[ref.Name()] && (ok || !duraOnly) {
+				seen[ref.Name()] = true
+				refs = append(refs, ref)
+			}
+		}); err != nil {
+			logger.Error().Err(err).Str("glob", glob).Msg("error encountered while iterating Dura refs")
+		}
+		return
+	}
+	for _, glob := range refGlobs() {
+		if err = collect(glob, true); err != nil {
+			return
+		}
+	}
+	for _, namespace := range []string{TagRefNamespace, ArchiveRefNamespace, BackupRefNamespace} {
+		if err = collect(namespace+"/*", false); err != nil {
+			return
+		}
+	}
+	if len(refs) == 0 {
+		log.Trace().Msg("leaving adoptRefs")
+		return
+	}
+
+	// The walk stops at the base commits and at the history of the branches of repo
+	if walk, err = repo.Walk(); err != nil {
+		return
+	}
+	defer walk.Free()
+	walk.Sorting(git.SortTopological | git.SortReverse)
+	for _, ref := range refs {
+		if err = walk.Push(ref.Target()); err != nil {
+			logger.Error().Err(err).Str("ref", ref.Name()).Msg("error encountered while walking Dura ref")
+			return
+		}
+		if base, oidErr := git.NewOid(refBase(ref.Name())); oidErr == nil {
+			if _, lookupErr := repo.LookupCommit(base); lookupErr == nil {
+				bases = append(bases, base)
+				_ = walk.Hide(base)
+			}
+		}
+	}
+	if err = eachRefOf(repo, LegacyRefNamespace+"/*", func(ref *git.Reference) {
+		if _, ok := refHead(ref.Name()); !ok && ref.Target() != nil {
+			_ = walk.Hide(ref.Target())
+		}
+	}); err != nil {
+		return
+	}
+	if walkErr := walk.Iterate(func(commit *git.Commit) bool {
+		if _, err = keepInShadow(repo, shadow, known, commit.Id()); err != nil {
+			return false
+		}
+		known, _ = commit.Tree()
+		return true
+	}); err == nil {
+		err = walkErr
+	}
+	if err == nil && len(bases) > 0 {
+		_, err = keepInShadow(repo, shadow, known, bases...)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("error encountered while copying snapshots to shadow repository")
+		return
+	}
+
+	// Every object is in shadow at this point, the refs can be moved
+	for _, ref := range refs {
+		var existing *git.Reference
+		if existing, err = shadow.References.Lookup(ref.Name()); err == nil {
+			if existing.Target() == nil || !existing.Target().Equal(ref.Target()) {
+				logger.Warn().Str("ref", ref.Name()).Msg("shadow repository holds another ref of the same name, leaving it in the repository")
+				continue
+			}
+		} else if git.IsErrorCode(err, git.ErrorCodeNotFound) {
+			_, err = shadow.References.Create(ref.Name(), ref.Target(), false, "dura: moved from the repository")
+		}
+		if err == nil {
+			err = ref.Delete()
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("ref", ref.Name()).Msg("error encountered while moving ref to shadow repository")
+			return
+		}
+		moved++
+	}
+	logger.Info().Int("moved", moved).Msg("moved Dura refs into shadow repository")
+	log.Trace().Msg("leaving adoptRefs")
+	return
+}
+
+// attachShadow adds the objects of the shadow repository of repo to its object
+// database when repo is shadowed: snapshot objects can be read through repo, and the
+// objects Dura writes through it go to the shadow repository. repo itself never
+// receives any object.
+func attachShadow(repo *git.Repository) (err error) {
+	if repo.IsBare() || !shadowed(repo.Workdir()) {
+		return
+	}
+	log.Trace().Msg("entered attachShadow")
+	var (
+		shadow *git.Repository
+		odb    *git.Odb
+	)
+	if shadow, err = openShadow(repo); err != nil {
+		return
+	}
+	if odb, err = repo.Odb(); err != nil {
+		return
+	}
+	if err = addShadowBackends(odb, shadow, shadowPriority, true); err != nil {
+		log.Error().Err(err).Str("shadow", shadow.Path()).Msg("error encountered while attaching shadow repository objects")
+		return
+	}
+	log.Trace().Msg("leaving attachShadow")
+	return
+}
+
+// addShadowBackends adds the loose objects and the packs of shadow to odb at priority,
+// the packs as alternates when packsAsAlternates is set. The shadow repository is only
+// packed by hand (git repack), its packs are read only.
+func addShadowBackends(odb *git.Odb, shadow *git.Repository, priority int, packsAsAlternates bool) (err error) {
+	var (
+		backend *git.OdbBackend
+		packs   []os.FileInfo
+	)
+	objects := filepath.Join(shadow.Path(), "objects")
+	if backend, err = git.NewOdbBackendLoose(objects, -1, false, 0, 0); err != nil {
+		return
+	}
+	if err = odb.AddBackend(backend, priority); err != nil {
+		return
+	}
+	if packs, err = readDir(filepath.Join(objects, "pack")); err != nil {
+		return
+	}
+	for _, pack := range packs {
+		if !strings.HasSuffix(pack.Name(), ".idx") {
+			continue
+		}
+		if backend, err = git.NewOdbBackendOnePack(filepath.Join(objects, "pack", pack.Name())); err != nil {
+			return
+		}
+		if packsAsAlternates {
+			err = odb.AddAlternate(backend, priority)
+		} else {
+			err = odb.AddBackend(backend, priority)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// shadowObjects returns an object database holding only the objects stored in shadow
+// itself, leaving out those it borrows through its alternates. Objects written to it go
+// to the loose objects of shadow.
+func shadowObjects(shadow *git.Repository) (odb *git.Odb, err error) {
+	if odb, err = git.NewOdb(); err != nil {
+		return
+	}
+	if err = addShadowBackends(odb, shadow, 1, false); err != nil {
+		log.Error().Err(err).Str("shadow", shadow.Path()).Msg("error encountered while opening shadow repository objects")
+		odb = nil
+	}
+	return
+}
+
+// keepInShadow copies to shadow the objects of the trees and commits of objects which it
+// only borrows from repo, so the snapshots of shadow don't depend on repo keeping them:
+// git gc drops the commits left behind by a rebase or a reset, and the blobs staged then
+// changed again, once they are unreachable from repo. known is a tree whose objects the
+// shadow repository is known to hold, its subtrees are skipped (nil if there is none).
+func keepInShadow(repo *git.Repository, shadow *git.Repository, known *git.Tree, objects ...*git.Oid) (copied int, err error) {
+	log.Trace().Msg("entered keepInShadow")
+	logger := log.With().Str("repo", repo.Path()).Str("shadow", shadow.Path()).Logger()
+	var (
+		src *git.Odb
+		dst *git.Odb
+	)
+	if src, err = repo.Odb(); err != nil {
+		return
+	}
+	if dst, err = shadowObjects(shadow); err != nil {
+		return
+	}
+	keep := func(id *git.Oid) (err error) {
+		if dst.Exists(id) {
+			return
+		}
+		var obj *git.OdbObject
+		if obj, err = src.Read(id); err != nil {
+			return
+		}
+		defer obj.Free()
+		if _, err = dst.Write(obj.Data(), obj.Type()); err == nil {
+			copied++
+		}
+		return
+	}
+	var keepTree func(id *git.Oid, known *git.Tree) error
+	keepTree = func(id *git.Oid, known *git.Tree) (err error) {
+		if known != nil && known.Id().Equal(id) {
+			return
+		}
+		var tree *git.Tree
+		if tree, err = repo.LookupTree(id); err != nil {
+			return
+		}
+		for i := uint64(0); i < tree.EntryCount(); i++ {
+			switch entry := tree.EntryByIndex(i); entry.Type {
+			case git.ObjectBlob:
+				err = keep(entry.Id)
+			case git.ObjectTree:
+				var knownSub *git.Tree
+				if known != nil {
+					if knownEntry := known.EntryByName(entry.Name); knownEntry != nil && knownEntry.Type == git.ObjectTree {
+						knownSub, _ = repo.LookupTree(knownEntry.Id)
+					}
+				}
+				err = keepTree(entry.Id, knownSub)
+			}
+			// Submodule commits belong to other repositories
+			if err != nil {
+				return
+			}
+		}
+		return keep(id)
+	}
+	for _, id := range objects {
+		var obj *git.Object
+		if obj, err = repo.Lookup(id); err != nil {
+			return
+		}
+		switch obj.Type() {
+		case git.ObjectCommit:
+			var commit *git.Commit
+			if commit, err = obj.AsCommit(); err == nil {
+				if err = keepTree(commit.TreeId(), known); err == nil {
+					err = keep(id)
+				}
+			}
+		case git.ObjectTree:
+			err = keepTree(id, known)
+		default:
+			err = keep(id)
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("object", id.String()).Msg("error encountered while copying objects to shadow repository")
+			return
+		}
+	}
+	logger.Debug().Int("copied", copied).Msg("objects kept in shadow repository")
+	log.Trace().Msg("leaving keepInShadow")
+	return
+}
+
+// duraStore returns the repository holding the Dura refs of repo: its shadow repository
+// when it is shadowed, otherwise repo itself.
+func duraStore(repo *git.Repository) (store *git.Repository, err error) {
+	if repo.IsBare() || !shadowed(repo.Workdir()) {
+		return repo, nil
+	}
+	return openShadow(repo)
+}
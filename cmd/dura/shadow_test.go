@@ -0,0 +1,60 @@
+package dura
+
+import (
+	git "github.com/libgit2/git2go/v33"
+	"testing"
+	"time"
+)
+
+func TestShadowAdoptsRefs(t *testing.T) {
+	savedCache := cacheHome
+	cacheHome = t.TempDir()
+	defer func() { cacheHome = savedCache }()
+	withCommitConfig(t, CommitConfig{Shadow: true}, func() {
+		repo := initTestRepo(t, map[string]string{"file.txt": "one\n"})
+		head, err := headPeelToCommit(repo)
+		if err != nil {
+			t.Fatalf("unable to read HEAD: %v", err)
+		}
+		s1 := testSnapshot(t, repo, "s1", time.Now().Add(-time.Minute), head)
+		s2 := testSnapshot(t, repo, "s2", time.Now(), s1)
+		refs := map[string]*git.Oid{
+			"refs/heads/dura/" + head.Id().String(): s2.Id(),
+			TagRefNamespace + "/keep":               s1.Id(),
+		}
+		for name, oid := range refs {
+			if _, err = repo.References.Create(name, oid, false, "test"); err != nil {
+				t.Fatalf("unable to create %s: %v", name, err)
+			}
+		}
+
+		var (
+			shadowed *git.Repository
+			shadow   *git.Repository
+			objects  *git.Odb
+			commit   *git.Commit
+		)
+		if shadowed, err = OpenRepository(repo.Workdir()); err != nil {
+			t.Fatalf("unable to open shadowed repository: %v", err)
+		}
+		if shadow, err = openShadow(shadowed); err != nil {
+			t.Fatalf("unable to open shadow repository: %v", err)
+		}
+		if objects, err = shadowObjects(shadow); err != nil {
+			t.Fatalf("unable to open shadow objects: %v", err)
+		}
+		for name, oid := range refs {
+			if _, err = repo.References.Lookup(name); !git.IsErrorCode(err, git.ErrorCodeNotFound) {
+				t.Errorf("%s is still in the repository (%v)", name, err)
+			}
+			if commit, err = lookupRefCommit(shadowed, name); err != nil || commit == nil || !commit.Id().Equal(oid) {
+				t.Errorf("%s was not moved into the shadow repository (%v)", name, err)
+			}
+		}
+		for _, commit := range []*git.Commit{s2, s1, head} {
+			if !objects.Exists(commit.Id()) || !objects.Exists(commit.TreeId()) {
+				t.Errorf("%s was not copied into the shadow repository", commit.Summary())
+			}
+		}
+	})
+}
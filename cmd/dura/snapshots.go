@@ -17,13 +17,22 @@ package dura
 
 import (
 	"errors"
-	"fmt"
 	git "github.com/libgit2/git2go/v33"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
 	"time"
 )
 
+var (
+	// ErrNoChanges is returned by a capture when the working tree has no changes
+	ErrNoChanges = errors.New("repository status list is empty")
+	// ErrNoDifferences is returned by a capture when the working tree matches the Dura
+	// ref's latest snapshot
+	ErrNoDifferences = errors.New("no differences detected")
+)
+
 type CaptureStatus struct {
 	DuraBranch string `json:"dura_branch"`
 	CommitHash string `json:"commit_hash"`
@@ -52,16 +61,24 @@ func IsRepo(path string) (isRepo bool, err error) {
 	return
 }
 
-func statusCheck(repo *git.Repository) (ok bool, err error) {
+func statusCheck(repo *git.Repository, filter *watchFilter) (ok bool, err error) {
 	log.Trace().Msg("entering statusCheck")
 	logger := log.With().Str("repo", repo.Path()).Logger()
 	logger.Trace().Msgf("checking status list of repository '%s'", repo.Path())
 	var (
 		statusList *git.StatusList
 		count      int
+		opts       *git.StatusOptions
 	)
-	logger.Trace().Interface("opt", nil).Msg("calling repo.StatusList(opt)")
-	if statusList, err = repo.StatusList(nil); err != nil {
+	if filter.hasInclude() {
+		logger.Trace().Msg("include patterns present, adding ignored files to status list")
+		opts = &git.StatusOptions{
+			Show:  git.StatusShowIndexAndWorkdir,
+			Flags: git.StatusOptIncludeUntracked | git.StatusOptRecurseUntrackedDirs | git.StatusOptIncludeIgnored | git.StatusOptRecurseIgnoredDirs,
+		}
+	}
+	logger.Trace().Interface("opt", opts).Msg("calling repo.StatusList(opt)")
+	if statusList, err = repo.StatusList(opts); err != nil {
 		logger.Error().Err(err).Msg("error encountered while calling repo.StatusList")
 		return
 	}
@@ -115,16 +132,46 @@ func headPeelToCommit(repo *git.Repository) (obj *git.Commit, err error) {
 	return
 }
 
+// Capture snapshots the repository at path using the watch configuration of the watched
+// directory containing it (see Config.WatchRootFor), or the default watch configuration
+// if it isn't watched.
 func Capture(path string) (cs *CaptureStatus, err error) {
 	log.Trace().Msg("entering Capture")
+	return captureWithFilter(path, filterFor(path), TriggerManual)
+}
+
+// filterFor returns the watch filter applying to the repository at path, that of the
+// watched directory containing it or the default one if it isn't watched.
+func filterFor(path string) *watchFilter {
+	if root, wc, ok := currentConfig().WatchRootFor(path); ok {
+		log.Debug().Str("path", path).Str("root", root).Msg("using watch configuration of watched directory")
+		abs, _ := filepath.Abs(path)
+		return newWatchFilter(wc, watchRelPath(root, abs))
+	}
+	return newWatchFilter(*NewWatchConfig(), "")
+}
+
+// CaptureWithConfig snapshots the repository at path, the include, exclude and max
+// depth settings of wc decide which working tree changes become part of the snapshot.
+func CaptureWithConfig(path string, wc WatchConfig) (cs *CaptureStatus, err error) {
+	log.Trace().Msg("entering CaptureWithConfig")
+	return captureWithFilter(path, newWatchFilter(wc, ""), TriggerManual)
+}
+
+// captureWithFilter snapshots the repository at path, trigger records what caused the
+// capture in the commit message.
+func captureWithFilter(path string, filter *watchFilter, trigger string) (cs *CaptureStatus, err error) {
+	log.Trace().Msg("entering captureWithFilter")
 	logger := log.With().Str("path", path).Logger()
 	var (
 		repo            *git.Repository
+		store           *git.Repository
 		head            *git.Commit
-		message         = "dura auto-backup"
 		statusCheckPass bool
 		branchName      string
+		refName         string
 		branchCommit    *git.Commit
+		unborn          bool
 	)
 	logger.Trace().Msgf("calling git.OpenRepository for path '%s'", path)
 	if repo, err = git.OpenRepository(path); err != nil {
@@ -132,79 +179,103 @@ func Capture(path string) (cs *CaptureStatus, err error) {
 		return
 	}
 	logger.Debug().Msgf("opened repository at '%s'", path)
+	logger.Trace().Msg("calling attachShadow")
+	if err = attachShadow(repo); err != nil {
+		logger.Error().Err(err).Msg("error encountered while attaching shadow repository")
+		return
+	}
+	logger.Trace().Msg("calling duraStore")
+	if store, err = duraStore(repo); err != nil {
+		logger.Error().Err(err).Msg("error encountered while opening the repository holding the Dura refs")
+		return
+	}
+	if store != repo {
+		logger = logger.With().Str("shadow", store.Path()).Logger()
+		logger.Debug().Msg("snapshots are kept in the shadow repository")
+	}
 
-	// Get the repo HEAD, peel to the latest Commit as "head"
-	logger.Trace().Msg("calling headPeelToCommit")
-	if head, err = headPeelToCommit(repo); err != nil {
-		logger.Error().Err(err).Msg("error encountered while calling headPeelToCommit")
+	// Get the repo HEAD, peel to the latest Commit as "head", an unborn branch has none
+	logger.Trace().Msg("calling repo.IsHeadUnborn")
+	if unborn, err = repo.IsHeadUnborn(); err != nil {
+		logger.Error().Err(err).Msg("error encountered while checking whether repository HEAD is unborn")
 		return
 	}
-	logger.Debug().Str("commit", head.Id().String()).Msg("successfully retrieved repository head commit")
+	if unborn {
+		logger.Debug().Msg("repository has no commits yet, snapshot will be a root commit")
+	} else {
+		logger.Trace().Msg("calling headPeelToCommit")
+		if head, err = headPeelToCommit(repo); err != nil {
+			logger.Error().Err(err).Msg("error encountered while calling headPeelToCommit")
+			return
+		}
+		logger.Debug().Str("commit", head.Id().String()).Msg("successfully retrieved repository head commit")
+	}
 
 	logger.Trace().Msg("executing statusCheck")
-	if statusCheckPass, err = statusCheck(repo); err != nil || !statusCheckPass {
+	if statusCheckPass, err = statusCheck(repo, filter); err != nil || !statusCheckPass {
 		if err == nil {
-			err = errors.New("repository status list is empty")
+			err = ErrNoChanges
 		}
 		logger.Error().Err(err).Msg("error encountered while executing statusCheck")
 		return
 	}
 	logger.Debug().Msg("repository passed status check")
 
-	if head.Id() != nil {
-		log.Trace().Msg("setting Dura branch name")
-		branchName = fmt.Sprintf("dura/%s", head.Id().String())
-		logger = logger.With().Str("branch", branchName).Logger()
-		logger.Debug().Msg("Dura branch name set")
-	} else {
-		err = errors.New("head.Id() was nil")
-		logger.Error().Err(err).Msg("head ID was nil, without it the Dura branch can be named")
+	log.Trace().Msg("setting Dura ref name")
+	if refName, err = duraRefName(repo, head, filter.wc); err != nil {
+		logger.Error().Err(err).Msg("error encountered while naming Dura ref")
 		return
 	}
+	branchName = shortRef(refName)
+	logger = logger.With().Str("ref", refName).Logger()
+	logger.Debug().Msg("Dura ref name set")
 
-	logger.Trace().Msg("calling findHead")
-	if branchCommit, err = findHead(repo, branchName); err != nil {
-		logger.Error().Err(err).Msgf("could not find head for branch %s, branch may not yet exist", branchName)
-		logger.Trace().Msg("checking if branch exists")
-		if _, err = repo.LookupBranch(branchName, git.BranchLocal); err != nil {
-			logger.Error().Err(err).Msgf("error encountered while looking for branch %s", branchName)
-			logger.Debug().Msgf("branch %s does not exist", branchName)
-			var branch *git.Branch
-			logger.Trace().Str("target", head.Id().String()).Msgf("creating branch %s", branchName)
-			if branch, err = repo.CreateBranch(branchName, head, false); err != nil {
-				logger.Error().Err(err).Msgf("error encountered while creating branch %s", branchName)
-				return
-			}
-			logger.Debug().Msgf("successfully created branch %s", branchName)
-			var commitObj *git.Object
-			logger.Trace().Msgf("find (peel to) latest commit for branch %s")
-			if commitObj, err = branch.Peel(git.ObjectCommit); err != nil {
-				logger.Error().Err(err).Msg("error encountered while peeling branch to latest commit")
+	logger.Trace().Msg("calling lookupRefCommit")
+	if branchCommit, err = lookupRefCommit(repo, refName); err != nil {
+		logger.Error().Err(err).Msgf("error encountered while looking up Dura ref %s", refName)
+		return
+	}
+	if branchCommit == nil && head != nil {
+		// Snapshots taken before the ref layout changed are continued rather than left
+		// beside a fresh ref of the same base, dura migrate then keeps the newer ref
+		if legacy := legacyRefName(head, filter.wc); legacy != refName {
+			if branchCommit, err = lookupRefCommit(repo, legacy); err != nil {
+				logger.Error().Err(err).Msgf("error encountered while looking up legacy Dura ref %s", legacy)
 				return
 			}
-			logger.Debug().Str("oid", commitObj.Id().String()).Msgf("peel to latest commit for branch %s was successful")
-			logger.Trace().Msg("casting commit object to git.Commit (commitObj.AsCommit())")
-			if branchCommit, err = commitObj.AsCommit(); err != nil {
-				logger.Error().Err(err).Msgf("error occured while casting %s to commit", commitObj.Id().String())
-				return
+			if branchCommit != nil {
+				logger.Debug().Str("legacy", legacy).Msgf("Dura ref %s does not exist yet, it will continue the legacy ref", refName)
 			}
-			logger.Debug().Str("commit", branchCommit.Id().String()).Msgf("successfully retrieved latest commit for branch %s", branchName)
 		}
 	}
+	if branchCommit == nil {
+		logger.Debug().Msgf("Dura ref %s does not exist yet, it will be created on top of the head commit", refName)
+	}
 
-	var index *git.Index
-	logger.Trace().Msg("retrieving repository index")
-	if index, err = repo.Index(); err != nil {
-		logger.Error().Err(err).Msgf("error encountered while retrieving repository (%s) index", repo.Path())
-		return
+	var previous *git.Commit
+	if currentConfig().Commit.Lineage {
+		logger.Trace().Msg("calling latestTip")
+		if previous, err = latestTip(repo, refName); err != nil {
+			logger.Warn().Err(err).Msg("error encountered while looking for the previous snapshot, it won't be linked")
+			previous, err = nil, nil
+		}
+		// Only the first snapshot taken since HEAD moved continues the previous ref
+		if previous != nil && branchCommit != nil && !previous.Committer().When.After(branchCommit.Committer().When) {
+			previous = nil
+		}
+		if previous != nil {
+			logger.Debug().Str("previous", previous.Id().String()).Msg("snapshot will continue from the previous snapshot")
+		}
 	}
-	logger.Debug().Msgf("successfully retrieved repository (%s) index", repo.Path())
-	logger.Trace().Msgf("add wildcard to repository (%s) index pathspec (*)", repo.Path())
-	if err = index.AddAll([]string{"*"}, git.IndexAddDefault, nil); err != nil {
-		logger.Error().Err(err).Msgf("error encountered while adding wildcard to repository (%s) index", repo.Path())
+
+	var index *git.Index
+	logger.Trace().Msg("calling snapshotIndex")
+	if index, err = snapshotIndex(repo, head, filter); err != nil {
+		logger.Error().Err(err).Msgf("error encountered while building snapshot index for repository (%s)", repo.Path())
 		return
 	}
-	logger.Trace().Msgf("successfully added wildcard to repository (%s) index pathsepc", repo.Path())
+	defer index.Free()
+	logger.Debug().Uint("entries", index.EntryCount()).Msgf("successfully built snapshot index for repository (%s)", repo.Path())
 
 	var (
 		dirtyDiff *git.Diff
@@ -217,6 +288,9 @@ func Capture(path string) (cs *CaptureStatus, err error) {
 		logger.Trace().Msg("retrieve branchCommit tree")
 		if oldTree, err = branchCommit.Tree(); err != nil {
 			logger.Error().Err(err).Msg("error encountered while retrieving branchCommit tree")
+			if head == nil {
+				return
+			}
 			logger.Trace().Msg("retrieve tree of repository head commit")
 			if oldTree, err = head.Tree(); err != nil {
 				logger.Error().Err(err).Msg("error encountered while retrieving tree of the repository head commit")
@@ -225,6 +299,8 @@ func Capture(path string) (cs *CaptureStatus, err error) {
 			logger.Debug().Msg("successfully retrieved tree of the repository head commit")
 		}
 		logger.Debug().Msg("successfully retrieved branchCommit tree")
+	} else if head == nil {
+		logger.Debug().Msg("branchCommit and head are nil, diffing against the empty tree")
 	} else {
 		logger.Debug().Msg("branchCommit is nil")
 		logger.Trace().Msg("retrieve tree of repository head commit")
@@ -246,20 +322,20 @@ func Capture(path string) (cs *CaptureStatus, err error) {
 	diffOpts.Pathspec = []string{"*"}
 	logger.Debug().Msg("diff options set")
 
-	logger.Trace().Str("oldTree", oldTree.Id().String()).Str("index", index.Path()).Msg("calling repo.DiffTreeToIndex")
+	logger.Trace().Msg("calling repo.DiffTreeToIndex")
 	if dirtyDiff, err = repo.DiffTreeToIndex(
 		oldTree,
 		index,
 		&diffOpts,
 	); err != nil {
-		logger.Error().Err(err).Str("oldTree", oldTree.Id().String()).Msg("error encountered while getting diff of tree-to-index")
+		logger.Error().Err(err).Msg("error encountered while getting diff of tree-to-index")
 		return
 	}
 	logger.Debug().Msg("successfully retrieved diffs")
 	logger.Trace().Msg("get number of deltas in diff")
 	if deltas, err = dirtyDiff.NumDeltas(); err != nil || deltas == 0 {
 		if err == nil {
-			err = errors.New("no differences detected")
+			err = ErrNoDifferences
 		}
 		logger.Error().Int("deltas", deltas).Err(err).Msg("error encountered while retrieving deltas")
 		return
@@ -270,9 +346,9 @@ func Capture(path string) (cs *CaptureStatus, err error) {
 		treeOid *git.Oid
 		tree    *git.Tree
 	)
-	logger.Trace().Msgf("write index (%s) to repository %s", index.Path(), repo.Path())
+	logger.Trace().Msgf("write snapshot index to repository %s", repo.Path())
 	if treeOid, err = index.WriteTreeTo(repo); err != nil {
-		logger.Error().Err(err).Msgf("error encountered attempting to write index (%s) to repository %s", index.Path(), repo.Path())
+		logger.Error().Err(err).Msgf("error encountered attempting to write snapshot index to repository %s", repo.Path())
 		return
 	}
 	logger.Debug().Str("tree", treeOid.String()).Msg("successfully wrote index to repository")
@@ -285,87 +361,163 @@ func Capture(path string) (cs *CaptureStatus, err error) {
 
 	logger.Trace().Msg("set commit signature")
 	var committer = &git.Signature{
-		Name:  getGitAuthor(repo),
-		Email: getGitEmail(repo),
-		When:  time.Time{},
+		Name:  getGitAuthor(repo, filter.wc),
+		Email: getGitEmail(repo, filter.wc),
+		When:  time.Now(),
 	}
 	logger.Debug().Dict("committer", zerolog.Dict().Str("Name", committer.Name).Str("Email", committer.Email).Time("When", committer.When)).Msg("commit signature set")
+	var author = committer
+	if authorTime := currentConfig().Commit.AuthorTime; authorTime == AuthorTimeMtime {
+		logger.Trace().Msg("setting author time to newest modification time of changed files")
+		author = &git.Signature{Name: committer.Name, Email: committer.Email, When: committer.When}
+		if mtime, ok := newestMtime(repo, dirtyDiff); ok {
+			author.When = mtime
+		}
+		logger.Debug().Time("When", author.When).Msg("author time set")
+	} else if authorTime != "" && authorTime != AuthorTimeCapture {
+		logger.Warn().Str("config.Commit.AuthorTime", authorTime).Msgf("unknown author time, using %s", AuthorTimeCapture)
+	}
+
+	var data *MessageData
+	logger.Trace().Msg("collecting commit message data")
+	if data, err = newMessageData(repo, head, dirtyDiff, trigger, committer.When); err != nil {
+		logger.Error().Err(err).Msg("error encountered while collecting commit message data")
+		return
+	}
+	if previous != nil {
+		data.Previous = previous.Id().String()
+	}
+	message := commitMessage(messageTemplate(filter.wc), data)
+	logger.Debug().Str("message", message).Msg("commit message rendered")
 
 	var (
-		oid    *git.Oid
-		commit = head
+		oid     *git.Oid
+		commit  = head
+		parents []*git.Oid
 	)
-	logger.Debug().Str("parent", commit.Id().String()).Msgf("set commit parent to head commit (%s)", commit.Id().String())
+	if commit != nil {
+		logger.Debug().Str("parent", commit.Id().String()).Msgf("set commit parent to head commit (%s)", commit.Id().String())
+	}
 	if branchCommit != nil {
 		logger.Trace().Msg("branchCommit is non-nil, setting commit parent to branchCommit")
 		commit = branchCommit
 		logger.Debug().Str("parent", commit.Id().String()).Msgf("set commit parent to branchCommit (%s)", commit.Id().String())
 	}
 
+	if commit != nil {
+		parents = append(parents, commit.Id())
+	} else {
+		logger.Debug().Msg("no parent, creating root commit")
+	}
+	if previous != nil {
+		logger.Trace().Msg("adding previous snapshot as second parent")
+		parents = append(parents, previous.Id())
+	}
+
+	// The shadow repository keeps its own copy of the objects the snapshot references, the
+	// tree of the snapshot it continues holds them already
+	if store != repo {
+		var known *git.Tree
+		if branchCommit != nil {
+			known, _ = branchCommit.Tree()
+		} else if previous != nil {
+			known, _ = previous.Tree()
+		}
+		if _, err = keepInShadow(repo, store, known, tree.Id()); err != nil {
+			return
+		}
+		if head != nil {
+			if _, err = keepInShadow(repo, store, tree, head.Id()); err != nil {
+				return
+			}
+		}
+	}
+
+	// The commit is created in the repository holding the Dura ref, its objects are
+	// written to the shadow repository (if any) through the object database of repo
 	logger.Trace().Msg("create commit")
-	logger = logger.With().Str("ref", fmt.Sprintf("refs/heads/%s", branchName)).Logger()
-	if oid, err = repo.CreateCommit(
-		fmt.Sprintf("refs/heads/%s", branchName),
-		committer,
+	if oid, err = store.CreateCommitFromIds(
+		refName,
+		author,
 		committer,
 		message,
-		tree,
-		commit,
+		tree.Id(),
+		parents...,
 	); err != nil {
 		logger.Error().Err(err).Msg("error encountered while creating commit")
 		return
 	}
-	logger.Debug().Msgf("successfully created commit (ref: %s)", fmt.Sprintf("refs/heads/%s", branchName))
+	logger.Debug().Msgf("successfully created commit (ref: %s)", refName)
 
 	logger.Trace().Msg("create capture status")
 	cs = &CaptureStatus{
 		DuraBranch: branchName,
 		CommitHash: oid.String(),
-		BaseHash:   head.Id().String(),
+	}
+	if head != nil {
+		cs.BaseHash = head.Id().String()
 	}
 	logger.Debug().Dict("cs", zerolog.Dict().Str("DuraBranch", cs.DuraBranch).Str("CommitHash", cs.CommitHash).Str("BaseHash", cs.BaseHash)).Msg("capture status created")
 
-	log.Trace().Msg("leaving Capture")
+	log.Trace().Msg("leaving captureWithFilter")
 	return
 }
 
-func findHead(repo *git.Repository, branchName string) (head *git.Commit, err error) {
-	log.Trace().Msg("entered findHead")
-	logger := log.With().Str("repo", repo.Path()).Logger()
-	var branch *git.Branch
-	logger.Trace().Msgf("looking for branch %s in repository %s", branchName, repo.Path())
-	if branch, err = repo.LookupBranch(branchName, git.BranchLocal); err != nil {
-		logger.Error().Err(err).Msgf("error encountered while searching for branch %s in repository %s", branchName, repo.Path())
+// newestMtime returns the newest modification time of the working tree files changed in
+// diff, in the local time zone. ok is false if none of them exist (only deletions).
+func newestMtime(repo *git.Repository, diff *git.Diff) (mtime time.Time, ok bool) {
+	deltas, err := diff.NumDeltas()
+	if err != nil {
 		return
-	} else {
-		logger.Debug().Msgf("found branch %s in repository %s", branchName, repo.Path())
-		var headObj *git.Object
-		logger.Trace().Msgf("peel to latest commit on branch %s", branchName)
-		if headObj, err = branch.Peel(git.ObjectCommit); err != nil {
-			logger.Error().Err(err).Msgf("error encountered while peeling to latest commit on branch %s in repository %s", branchName, repo.Path())
-			return
+	}
+	for i := 0; i < deltas; i++ {
+		delta, deltaErr := diff.Delta(i)
+		if deltaErr != nil || delta.Status == git.DeltaDeleted {
+			continue
 		}
-		logger.Debug().Msgf("successfully retrieved latest branch (%s) commit", branchName)
-		logger.Trace().Msg("cast commit object to git.Commit")
-		if head, err = headObj.AsCommit(); err != nil {
-			logger.Error().Err(err).Msg("error encountered while attempting to cast object to git.Commit")
-			return
+		fileInfo, statErr := os.Lstat(filepath.Join(repo.Workdir(), filepath.FromSlash(delta.NewFile.Path)))
+		if statErr != nil {
+			continue
+		}
+		if !ok || fileInfo.ModTime().After(mtime) {
+			mtime, ok = fileInfo.ModTime(), true
 		}
-		logger.Debug().Msgf("successfully retrieved head commit (%s) for branch %s in repository %s", head.Id().String(), branchName, repo.Path())
 	}
-	log.Trace().Msg("leaving findHead")
+	mtime = mtime.Local()
 	return
 }
 
-func getGitAuthor(repo *git.Repository) (author string) {
+// branchPrefix returns the prefix of the Dura branches of repositories watched with wc.
+func branchPrefix(wc WatchConfig) string {
+	if wc.BranchPrefix != "" {
+		return wc.BranchPrefix
+	}
+	return DefBranchPrefix
+}
+
+// messageTemplate returns the commit message template of repositories watched with wc.
+func messageTemplate(wc WatchConfig) string {
+	if wc.MessageTemplate != "" {
+		return wc.MessageTemplate
+	}
+	return currentConfig().Commit.MessageTemplate
+}
+
+func getGitAuthor(repo *git.Repository, wc WatchConfig) (author string) {
 	log.Trace().Msg("entered getGitAuthor")
 	logger := log.With().Str("repo", repo.Path()).Logger()
-	if config.Commit.Author != nil {
-		author = *config.Commit.Author
+	if wc.Author != nil {
+		author = *wc.Author
+		logger.Debug().Str("author", author).Msgf("found author set in watch configuration (%s)", author)
+		return
+	}
+	settings := currentConfig()
+	if settings.Commit.Author != nil {
+		author = *settings.Commit.Author
 		logger.Debug().Str("author", author).Msgf("found author set in config (%s)", author)
 		return
 	}
-	if !config.Commit.ExcludeGitConfig {
+	if !settings.Commit.ExcludeGitConfig {
 		var signature *git.Signature
 		logger.Trace().Msg("retrieving default signature for repository")
 		if signature, err = repo.DefaultSignature(); err == nil {
@@ -382,15 +534,21 @@ func getGitAuthor(repo *git.Repository) (author string) {
 	return
 }
 
-func getGitEmail(repo *git.Repository) (email string) {
+func getGitEmail(repo *git.Repository, wc WatchConfig) (email string) {
 	log.Trace().Msg("entered getGitEmail")
 	logger := log.With().Str("repo", repo.Path()).Logger()
-	if config.Commit.Email != nil {
-		email = *config.Commit.Email
+	if wc.Email != nil {
+		email = *wc.Email
+		logger.Debug().Str("email", email).Msgf("found email set in watch configuration (%s)", email)
+		return
+	}
+	settings := currentConfig()
+	if settings.Commit.Email != nil {
+		email = *settings.Commit.Email
 		logger.Debug().Str("email", email).Msgf("found email set in config (%s)", email)
 		return
 	}
-	if !config.Commit.ExcludeGitConfig {
+	if !settings.Commit.ExcludeGitConfig {
 		var signature *git.Signature
 		logger.Trace().Msg("retrieving default signature for repository")
 		if signature, err = repo.DefaultSignature(); err == nil {
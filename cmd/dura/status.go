@@ -0,0 +1,190 @@
+package dura
+
+import (
+	"errors"
+	"github.com/rs/zerolog/log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// repoStats holds the daemon's capture statistics keyed by repository path
+	repoStats   = map[string]*repoStat{}
+	repoStatsMu sync.Mutex
+)
+
+// repoStat accumulates the outcome of every capture of a single repository.
+type repoStat struct {
+	lastRun      time.Time
+	lastCapture  time.Time
+	capture      *CaptureStatus
+	lastError    string
+	lastErrorAt  time.Time
+	runs         int
+	idleRuns     int
+	totalLatency time.Duration
+}
+
+// Status is the state reported by dura status, the daemon fields are only set while a
+// daemon is running.
+type Status struct {
+	Running bool          `json:"running"`
+	Daemon  *DaemonStatus `json:"daemon,omitempty"`
+	Repos   []RepoStatus  `json:"repos"`
+}
+
+// RepoStatus describes the captures of a single repository made by the running daemon.
+// Root is the watched directory the repository was found in, a watched directory the
+// daemon hasn't captured any repository of yet is reported with Path equal to Root.
+type RepoStatus struct {
+	Path           string         `json:"path"`
+	Root           string         `json:"root"`
+	LastRun        *time.Time     `json:"last_run,omitempty"`
+	LastCapture    *time.Time     `json:"last_capture,omitempty"`
+	Capture        *CaptureStatus `json:"capture,omitempty"`
+	LastError      string         `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time     `json:"last_error_at,omitempty"`
+	Runs           int            `json:"runs"`
+	IdleRuns       int            `json:"idle_runs"`
+	AverageLatency time.Duration  `json:"average_latency_ns"`
+}
+
+// Uptime returns how long the daemon has been running, zero if unknown.
+func (ds *DaemonStatus) Uptime() time.Duration {
+	if ds.StartedAt.IsZero() {
+		return 0
+	}
+	return time.Since(ds.StartedAt).Round(time.Second)
+}
+
+// recordCapture stores the outcome of a capture of repo in the daemon's statistics. A
+// capture which found nothing to snapshot (ErrNoChanges, ErrNoDifferences) is an idle
+// run, neither an error nor part of the average latency.
+func recordCapture(repo string, cs *CaptureStatus, err error, latency time.Duration) {
+	repoStatsMu.Lock()
+	defer repoStatsMu.Unlock()
+	stat, ok := repoStats[repo]
+	if !ok {
+		stat = &repoStat{}
+		repoStats[repo] = stat
+	}
+	now := time.Now()
+	stat.lastRun = now
+	stat.runs++
+	if errors.Is(err, ErrNoChanges) || errors.Is(err, ErrNoDifferences) {
+		stat.idleRuns++
+		return
+	}
+	stat.totalLatency += latency
+	if cs != nil {
+		stat.lastCapture = now
+		stat.capture = cs
+	}
+	if err != nil {
+		stat.lastError = err.Error()
+		stat.lastErrorAt = now
+	}
+}
+
+// repoStatuses reports the daemon's statistics for every watched directory, each
+// repository captured beneath it is listed separately in path order.
+func repoStatuses() (statuses []RepoStatus) {
+	log.Trace().Msg("entered repoStatuses")
+	repoStatsMu.Lock()
+	defer repoStatsMu.Unlock()
+	var roots []string
+	settings := currentConfig()
+	for root := range settings.GitRepos() {
+		if abs, absErr := filepath.Abs(root); absErr == nil {
+			root = abs
+		}
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	var paths []string
+	for repo := range repoStats {
+		paths = append(paths, repo)
+	}
+	sort.Strings(paths)
+	statuses = []RepoStatus{}
+	for _, root := range roots {
+		found := false
+		for _, repo := range paths {
+			if owner, _, ok := settings.WatchRootFor(repo); !ok || owner != root {
+				continue
+			}
+			found = true
+			statuses = append(statuses, repoStats[repo].status(repo, root))
+		}
+		if !found {
+			statuses = append(statuses, RepoStatus{Path: root, Root: root})
+		}
+	}
+	log.Trace().Msg("leaving repoStatuses")
+	return
+}
+
+func (s *repoStat) status(repo string, root string) (rs RepoStatus) {
+	rs = RepoStatus{
+		Path:      repo,
+		Root:      root,
+		Capture:   s.capture,
+		LastError: s.lastError,
+		Runs:      s.runs,
+		IdleRuns:  s.idleRuns,
+	}
+	if s.runs > 0 {
+		lastRun := s.lastRun
+		rs.LastRun = &lastRun
+	}
+	if s.runs > s.idleRuns {
+		rs.AverageLatency = s.totalLatency / time.Duration(s.runs-s.idleRuns)
+	}
+	if !s.lastCapture.IsZero() {
+		lastCapture := s.lastCapture
+		rs.LastCapture = &lastCapture
+	}
+	if !s.lastErrorAt.IsZero() {
+		lastErrorAt := s.lastErrorAt
+		rs.LastErrorAt = &lastErrorAt
+	}
+	return
+}
+
+// GetStatus asks the running daemon for its status. If no daemon can be reached the
+// watched directories are reported without any capture statistics, along with the PID
+// of a daemon still holding the runtime lock (one not serving the control socket).
+func GetStatus() (status *Status, err error) {
+	log.Trace().Msg("entered GetStatus")
+	var resp *ControlResponse
+	if resp, err = CallDaemon(ControlRequest{Command: ControlStatus}); err == nil {
+		status = &Status{Running: true, Daemon: resp.Status, Repos: resp.Status.Repos}
+		resp.Status.Repos = nil
+		log.Trace().Msg("leaving GetStatus")
+		return
+	}
+	if !errors.Is(err, ErrNoDaemon) {
+		log.Error().Err(err).Msg("error encountered while requesting daemon status")
+		return
+	}
+	err = nil
+	status = &Status{Repos: repoStatuses()}
+	var holder *uint32
+	if holder, err = runtimeLock.Holder(); err != nil {
+		log.Error().Err(err).Msg("error encountered while retrieving runtime lock holder")
+		return
+	}
+	if holder != nil {
+		settings := currentConfig()
+		status.Running = true
+		status.Daemon = &DaemonStatus{
+			Pid:        *holder,
+			ConfigFile: settings.DefaultPath(),
+			Mode:       settings.Dura.Mode,
+		}
+	}
+	log.Trace().Msg("leaving GetStatus")
+	return
+}
@@ -0,0 +1,156 @@
+package dura
+
+import (
+	"fmt"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// TagRefNamespace is where Dura tags are stored, outside of refs/tags so they are
+	// neither listed nor pushed along with the tags of the repository
+	TagRefNamespace = "refs/dura-tags"
+)
+
+// SnapshotTag is a named, protected snapshot created with CreateTag.
+type SnapshotTag struct {
+	Name     string    `json:"name"`
+	Snapshot string    `json:"snapshot"`
+	Note     string    `json:"note,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// tagRefName returns the full ref name of the Dura tag name.
+func tagRefName(name string) (ref string, err error) {
+	ref = fmt.Sprintf("%s/%s", TagRefNamespace, strings.Trim(name, "/"))
+	if valid, _ := git.ReferenceNameIsValid(ref); !valid || strings.Trim(name, "/") == "" {
+		err = fmt.Errorf("'%s' is not a valid tag name", name)
+	}
+	return
+}
+
+// CreateTag names snapshot, protecting it and the snapshots it descends from from
+// dura prune and dura gc. The tag is an annotated tag object holding note, referenced
+// from TagRefNamespace. An existing tag is only moved when force is true.
+func CreateTag(repo *git.Repository, name string, snapshot *git.Commit, note string, force bool) (tag *SnapshotTag, err error) {
+	log.Trace().Msg("entered CreateTag")
+	logger := log.With().Str("repo", repo.Path()).Str("tag", name).Logger()
+	var (
+		ref   string
+		store *git.Repository
+		odb   *git.Odb
+		oid   *git.Oid
+	)
+	if ref, err = tagRefName(name); err != nil {
+		return
+	}
+	if store, err = duraStore(repo); err != nil {
+		return
+	}
+	wc := currentConfig().WatchConfigFor(repo.Workdir())
+	tagger := &git.Signature{
+		Name:  getGitAuthor(repo, wc),
+		Email: getGitEmail(repo, wc),
+		When:  time.Now(),
+	}
+	message := strings.TrimSpace(note)
+	if message != "" {
+		message += "\n"
+	}
+	// git2go can only create tag objects along with a refs/tags/ ref, so the object is
+	// written directly
+	object := fmt.Sprintf("object %s\ntype commit\ntag %s\ntagger %s <%s> %d %s\n\n%s",
+		snapshot.Id().String(),
+		strings.Trim(name, "/"),
+		tagger.Name, tagger.Email, tagger.When.Unix(), tagger.When.Format("-0700"),
+		message,
+	)
+	if odb, err = store.Odb(); err != nil {
+		return
+	}
+	if oid, err = odb.Write([]byte(object), git.ObjectTag); err != nil {
+		logger.Error().Err(err).Msg("error encountered while writing tag object")
+		return
+	}
+	if _, err = store.References.Create(ref, oid, force, fmt.Sprintf("dura tag: %s", snapshot.Id().String())); err != nil {
+		if git.IsErrorCode(err, git.ErrorCodeExists) {
+			err = fmt.Errorf("tag '%s' already exists", name)
+		}
+		logger.Error().Err(err).Msg("error encountered while creating tag ref")
+		return
+	}
+	tag = &SnapshotTag{Name: strings.Trim(name, "/"), Snapshot: snapshot.Id().String(), Note: strings.TrimSpace(note), Time: tagger.When}
+	logger.Debug().Str("snapshot", tag.Snapshot).Msg("tag created")
+	log.Trace().Msg("leaving CreateTag")
+	return
+}
+
+// DeleteTag removes the Dura tag name, the snapshot is no longer protected by it.
+func DeleteTag(repo *git.Repository, name string) (err error) {
+	log.Trace().Msg("entered DeleteTag")
+	var (
+		ref       string
+		store     *git.Repository
+		reference *git.Reference
+	)
+	if ref, err = tagRefName(name); err != nil {
+		return
+	}
+	if store, err = duraStore(repo); err != nil {
+		return
+	}
+	if reference, err = store.References.Lookup(ref); err != nil {
+		if git.IsErrorCode(err, git.ErrorCodeNotFound) {
+			err = fmt.Errorf("tag '%s' does not exist", name)
+		}
+		return
+	}
+	if err = reference.Delete(); err != nil {
+		log.Error().Err(err).Str("tag", name).Msg("error encountered while deleting tag ref")
+		return
+	}
+	log.Trace().Msg("leaving DeleteTag")
+	return
+}
+
+// Tags returns the Dura tags of repo, sorted by name.
+func Tags(repo *git.Repository) (tags []SnapshotTag, err error) {
+	log.Trace().Msg("entered Tags")
+	err = eachRef(repo, TagRefNamespace+"/*", func(ref *git.Reference) {
+		tag := SnapshotTag{Name: strings.TrimPrefix(ref.Name(), TagRefNamespace+"/")}
+		obj, lookupErr := repo.Lookup(ref.Target())
+		if lookupErr != nil {
+			log.Warn().Err(lookupErr).Str("ref", ref.Name()).Msg("unable to read tag, skipping")
+			return
+		}
+		if annotated, tagErr := obj.AsTag(); tagErr == nil {
+			tag.Snapshot = annotated.TargetId().String()
+			tag.Note = strings.TrimSpace(annotated.Message())
+			if tagger := annotated.Tagger(); tagger != nil {
+				tag.Time = tagger.When
+			}
+		} else {
+			tag.Snapshot = ref.Target().String()
+		}
+		tags = append(tags, tag)
+	})
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	log.Trace().Msg("leaving Tags")
+	return
+}
+
+// taggedSnapshots returns the hashes of the snapshots named by Dura tags.
+func taggedSnapshots(repo *git.Repository) (tagged map[string]bool, err error) {
+	var tags []SnapshotTag
+	if tags, err = Tags(repo); err != nil {
+		return
+	}
+	tagged = map[string]bool{}
+	for _, tag := range tags {
+		tagged[tag.Snapshot] = true
+	}
+	return
+}
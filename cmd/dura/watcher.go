@@ -0,0 +1,405 @@
+package dura
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	git "github.com/libgit2/git2go/v33"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// errWatchLimit is returned by runWatcher when the operating system's file watch
+	// limits have been exhausted, the caller is expected to fall back to polling.
+	errWatchLimit = errors.New("file system watch limit reached")
+	// rescanInterval is how often watched directories are searched for new repositories
+	// in addition to the rescans triggered by directory creation events.
+	rescanInterval = time.Minute
+)
+
+// repoWatch is the state the watcher keeps for each repository it follows.
+type repoWatch struct {
+	path string
+	// root and wc are the watched directory and configuration filter was built from
+	root   string
+	wc     WatchConfig
+	filter *watchFilter
+	repo   *git.Repository
+	timer  *time.Timer
+}
+
+// fsWatcher follows the working trees of all watched repositories and debounces bursts
+// of file system events into a single capture per repository.
+type fsWatcher struct {
+	watcher  *fsnotify.Watcher
+	debounce time.Duration
+	repos    map[string]*repoWatch
+	// owners maps each watched directory inside a working tree to its repository
+	owners map[string]*repoWatch
+	// scanDirs maps each watched directory between a watched root and its repositories
+	// to the root, creating something within them triggers a rescan of that root
+	scanDirs map[string]string
+	captures chan *repoWatch
+	// done is closed once the watcher stops, releasing debounce timers firing after that
+	done chan struct{}
+}
+
+// runWatcher captures repositories whenever their working trees change, a capture runs
+// once no further changes have been seen for the configured debounce period. It returns
+// nil once a shutdown is requested, errWatchLimit signals that watches could not be added.
+func runWatcher() (err error) {
+	log.Trace().Msg("entered runWatcher")
+	w := &fsWatcher{
+		debounce: debounceDuration(),
+		repos:    map[string]*repoWatch{},
+		owners:   map[string]*repoWatch{},
+		scanDirs: map[string]string{},
+		captures: make(chan *repoWatch, 64),
+		done:     make(chan struct{}),
+	}
+	log.Trace().Msg("creating file system watcher")
+	if w.watcher, err = fsnotify.NewWatcher(); err != nil {
+		log.Error().Err(err).Msg("error encountered while creating file system watcher")
+		return
+	}
+	defer w.watcher.Close()
+	defer w.stop()
+
+	log.Trace().Msg("scanning watched directories")
+	if err = w.scanAll(); err != nil {
+		log.Error().Err(err).Msg("error encountered while scanning watched directories")
+		return
+	}
+	log.Info().Int("repos", len(w.repos)).Int("dirs", len(w.owners)+len(w.scanDirs)).Dur("debounce", w.debounce).Msg("watching repositories for changes")
+
+	rescan := time.NewTicker(rescanInterval)
+	defer rescan.Stop()
+	for {
+		select {
+		case <-shutdown:
+			log.Debug().Msg("shutdown requested, stopping file system watcher")
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if err = w.handle(event); err != nil {
+				log.Error().Err(err).Str("file", event.Name).Msg("error encountered while handling file system event")
+				return
+			}
+		case watchErr, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(watchErr).Msg("file system watcher reported an error")
+		case rw := <-w.captures:
+			if w.repos[rw.path] != rw {
+				log.Trace().Str("repo", rw.path).Msg("repository no longer followed, dropping capture")
+				continue
+			}
+			if isPaused() {
+				log.Trace().Str("repo", rw.path).Msg("captures paused, deferring capture")
+				w.schedule(rw)
+				continue
+			}
+			log.Trace().Msgf("calling processDirectory for '%s'", rw.path)
+			if err = processDirectory(rw.path, rw.filter, TriggerFsEvent); err != nil {
+				log.Error().Err(err).Msgf("error encountered while processing '%s', will continue", rw.path)
+				err = nil
+			}
+		case <-rescans:
+			log.Debug().Msg("rescan of watched directories requested")
+			if err = w.scanAll(); err != nil {
+				log.Error().Err(err).Msg("error encountered while rescanning watched directories")
+				return
+			}
+		case <-rescan.C:
+			log.Trace().Msg("periodic rescan of watched directories")
+			if err = w.scanAll(); err != nil {
+				log.Error().Err(err).Msg("error encountered while rescanning watched directories")
+				return
+			}
+			maybePrune()
+			maybeBackup()
+		}
+	}
+}
+
+// debounceDuration returns dura.debounce_millis, or DefDebounceMillis if that is less than
+// 1 millisecond.
+func debounceDuration() time.Duration {
+	millis := currentConfig().Dura.DebounceMillis
+	if millis < 1 {
+		millis = DefDebounceMillis
+	}
+	return time.Duration(millis) * time.Millisecond
+}
+
+// scanAll (re)discovers the repositories of every watched directory. Repositories no
+// longer found in any of them, after the configuration was reloaded for instance, stop
+// being followed, as do the directories of roots which are no longer watched.
+func (w *fsWatcher) scanAll() (err error) {
+	roots := currentConfig().GitRepos()
+	found := map[string]bool{}
+	for root, wc := range roots {
+		var repos []string
+		if repos, err = w.scanRoot(root, wc); err != nil {
+			return
+		}
+		for _, repoPath := range repos {
+			found[repoPath] = true
+		}
+	}
+	for repoPath, rw := range w.repos {
+		if !found[repoPath] {
+			log.Debug().Str("repo", repoPath).Msg("repository no longer watched, no longer following it")
+			w.drop(rw)
+		}
+	}
+	for dir, root := range w.scanDirs {
+		if _, watched := roots[root]; !watched {
+			_ = w.watcher.Remove(dir)
+			delete(w.scanDirs, dir)
+		}
+	}
+	return
+}
+
+// scanRoot discovers the repositories beneath the watched directory root, watching the
+// directories leading to them and the working trees of any repositories not yet
+// followed. Newly followed repositories are captured once straight away, those whose
+// watch configuration changed are watched again with it. The repositories followed
+// beneath root are returned, or those already followed if root can't be searched.
+func (w *fsWatcher) scanRoot(root string, wc WatchConfig) (repos []string, err error) {
+	log.Trace().Msg("entered scanRoot")
+	var dirs []string
+	if repos, err = discover(root, wc, &dirs); err != nil {
+		log.Error().Err(err).Msgf("error encountered while discovering repositories in '%s', will continue", root)
+		repos = nil
+		for repoPath, rw := range w.repos {
+			if rw.root == root {
+				repos = append(repos, repoPath)
+			}
+		}
+		return repos, nil
+	}
+	scanned := map[string]bool{}
+	for _, dir := range dirs {
+		if err = w.add(dir); err != nil {
+			return
+		}
+		w.scanDirs[dir] = root
+		scanned[dir] = true
+	}
+	for dir, dirRoot := range w.scanDirs {
+		if dirRoot == root && !scanned[dir] {
+			_ = w.watcher.Remove(dir)
+			delete(w.scanDirs, dir)
+		}
+	}
+	settings := currentConfig()
+	for _, repoPath := range repos {
+		// Like captures, a repository within several watched directories follows the
+		// configuration of the closest one
+		repoRoot, repoWc := root, wc
+		if closest, closestWc, ok := settings.WatchRootFor(repoPath); ok {
+			repoRoot, repoWc = closest, closestWc
+		}
+		if rw, ok := w.repos[repoPath]; ok {
+			if rw.root == repoRoot && reflect.DeepEqual(rw.wc, repoWc) {
+				continue
+			}
+			log.Debug().Str("repo", repoPath).Msg("watch configuration changed, watching repository again")
+			w.unwatchTree(rw)
+			rw.root, rw.wc = repoRoot, repoWc
+			rw.filter = newWatchFilter(repoWc, watchRelPath(repoRoot, repoPath))
+			if err = w.addTree(rw, repoPath); err != nil {
+				return
+			}
+			continue
+		}
+		rw := &repoWatch{
+			path:   repoPath,
+			root:   repoRoot,
+			wc:     repoWc,
+			filter: newWatchFilter(repoWc, watchRelPath(repoRoot, repoPath)),
+		}
+		if rw.repo, err = git.OpenRepository(repoPath); err != nil {
+			log.Error().Err(err).Msgf("error encountered while opening repository '%s', will continue", repoPath)
+			err = nil
+			continue
+		}
+		log.Debug().Str("repo", repoPath).Msg("following repository working tree")
+		w.repos[repoPath] = rw
+		if err = w.addTree(rw, repoPath); err != nil {
+			return
+		}
+		w.schedule(rw)
+	}
+	log.Trace().Msg("leaving scanRoot")
+	return
+}
+
+// addTree watches dir and every directory below it that belongs to the working tree of
+// rw, skipping .git, nested repositories, excluded paths and ignored or too deep paths
+// which aren't included.
+func (w *fsWatcher) addTree(rw *repoWatch, dir string) (err error) {
+	rel := watchRelPath(rw.path, dir)
+	if rel != "" {
+		ignored, _ := rw.repo.IsPathIgnored(rel + "/")
+		if isWorktree(dir) || rw.filter.excluded(rel+"/") || (!rw.filter.included(rel+"/") && (ignored || rw.filter.tooDeep(rel+"/file"))) {
+			log.Trace().Str("dir", dir).Msg("directory not part of watched working tree, skipping")
+			return
+		}
+	}
+	if err = w.add(dir); err != nil {
+		return
+	}
+	w.owners[dir] = rw
+	var entries []os.FileInfo
+	if entries, err = ioutil.ReadDir(dir); err != nil {
+		log.Warn().Err(err).Str("dir", dir).Msg("unable to read directory while adding watches, skipping")
+		return nil
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == ".git" {
+			continue
+		}
+		if err = w.addTree(rw, filepath.Join(dir, entry.Name())); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// add watches dir, translating exhausted watch limits into errWatchLimit.
+func (w *fsWatcher) add(dir string) (err error) {
+	if err = w.watcher.Add(dir); err != nil {
+		if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE) {
+			log.Warn().Err(err).Str("dir", dir).Msg("file system watch limit reached")
+			return errWatchLimit
+		}
+		log.Warn().Err(err).Str("dir", dir).Msg("unable to watch directory, skipping")
+		return nil
+	}
+	return
+}
+
+// handle processes a single file system event.
+func (w *fsWatcher) handle(event fsnotify.Event) (err error) {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		w.forget(event.Name)
+	}
+	parent := filepath.Dir(event.Name)
+	if rw, ok := w.owners[parent]; ok {
+		rel := watchRelPath(rw.path, event.Name)
+		if rel == ".git" || path.Base(rel) == ".git" {
+			return
+		}
+		if event.Op&fsnotify.Create != 0 {
+			if fileInfo, statErr := os.Lstat(event.Name); statErr == nil && fileInfo.IsDir() {
+				log.Trace().Str("dir", event.Name).Msg("directory created in working tree")
+				if err = w.addTree(rw, event.Name); err != nil {
+					return
+				}
+			}
+		}
+		ignored, _ := rw.repo.IsPathIgnored(rel)
+		if !rw.filter.allows(rel, ignored) {
+			log.Trace().Str("file", rel).Msg("change filtered out by watch configuration")
+			return
+		}
+		log.Trace().Str("repo", rw.path).Str("file", rel).Str("op", event.Op.String()).Msg("working tree change detected")
+		w.schedule(rw)
+		return
+	}
+	if root, ok := w.scanDirs[parent]; ok && event.Op&fsnotify.Create != 0 {
+		log.Debug().Str("root", root).Str("path", event.Name).Msg("path created in watched directory, rescanning")
+		if wc, watched := currentConfig().GitRepos()[root]; watched {
+			_, err = w.scanRoot(root, wc)
+		}
+	}
+	return
+}
+
+// schedule (re)starts the debounce timer of rw, once it fires rw is queued for capture.
+func (w *fsWatcher) schedule(rw *repoWatch) {
+	if rw.timer != nil {
+		rw.timer.Stop()
+	}
+	rw.timer = time.AfterFunc(w.debounce, func() {
+		select {
+		case w.captures <- rw:
+		case <-w.done:
+		}
+	})
+}
+
+// forget drops the watches of dir and of every directory below it, a removed or renamed
+// directory is watched again from its new location by the next scan. Repositories whose
+// working tree goes along with it are no longer followed.
+func (w *fsWatcher) forget(dir string) {
+	within := func(p string) bool {
+		return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+	}
+	for owned, rw := range w.owners {
+		if within(owned) {
+			_ = w.watcher.Remove(owned)
+			delete(w.owners, owned)
+		}
+		if within(rw.path) {
+			delete(w.owners, owned)
+		}
+	}
+	for scanned := range w.scanDirs {
+		if within(scanned) {
+			_ = w.watcher.Remove(scanned)
+			delete(w.scanDirs, scanned)
+		}
+	}
+	for repoPath, rw := range w.repos {
+		if within(repoPath) {
+			log.Debug().Str("repo", repoPath).Msg("working tree removed, no longer following repository")
+			if rw.timer != nil {
+				rw.timer.Stop()
+			}
+			delete(w.repos, repoPath)
+		}
+	}
+}
+
+// unwatchTree drops the watches of the working tree of rw.
+func (w *fsWatcher) unwatchTree(rw *repoWatch) {
+	for owned, owner := range w.owners {
+		if owner == rw {
+			_ = w.watcher.Remove(owned)
+			delete(w.owners, owned)
+		}
+	}
+}
+
+// drop stops following the repository of rw.
+func (w *fsWatcher) drop(rw *repoWatch) {
+	w.unwatchTree(rw)
+	if rw.timer != nil {
+		rw.timer.Stop()
+	}
+	delete(w.repos, rw.path)
+}
+
+// stop stops the pending debounce timers, those already firing are released by done.
+func (w *fsWatcher) stop() {
+	close(w.done)
+	for _, rw := range w.repos {
+		if rw.timer != nil {
+			rw.timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcBranches     []string
+	gcArchive      bool
+	gcDryRun       bool
+	gcPruneObjects bool
+	gcPruneExpire  int
+	gcAll          bool
+	gcJSON         bool
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc [path]",
+	Short: "Removes Dura refs whose work is fully committed",
+	Long: `Collects the Dura refs of the repository containing path (the current directory by default), or of every watched repository
+with --all, whose newest snapshot is fully committed: its tree is the tree of a commit reachable from one of the branches given with
+--branch (gc.branches, main and master by default). These refs are deleted, or with --archive (or gc.archive) moved to
+refs/dura-archive/ where Dura no longer reads them. Refs holding a snapshot tagged with dura tag are never collected.
+
+With --prune-objects, the loose objects which are no longer reachable from any ref, reflog, HEAD or the index and are older than
+--prune-expire days (gc.prune_expire_days, 14 by default) are removed afterwards. Packed objects are left to git gc.
+
+--dry-run reports what would be collected and pruned without changing anything.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			path = CWD
+			opts = dura.GCOptions{
+				Branches:     gcBranches,
+				Archive:      gcArchive,
+				DryRun:       gcDryRun,
+				PruneObjects: gcPruneObjects,
+				PruneExpire:  time.Duration(gcPruneExpire) * 24 * time.Hour,
+			}
+			results []dura.GCResult
+			failed  bool
+		)
+		if len(args) > 0 {
+			path = args[0]
+		}
+		if gcAll {
+			if len(args) > 0 {
+				cobra.CheckErr(errors.New("a path can't be given along with --all"))
+			}
+			results = dura.GCAll(opts)
+		} else {
+			var result *dura.GCResult
+			if result, err = dura.GC(path, opts); result == nil {
+				result = &dura.GCResult{Repo: path}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, *result)
+		}
+		for _, result := range results {
+			failed = failed || result.Error != ""
+		}
+		if gcJSON {
+			var bytes []byte
+			bytes, err = json.MarshalIndent(results, "", "  ")
+			cobra.CheckErr(err)
+			fmt.Println(string(bytes))
+		} else {
+			printGC(results)
+		}
+		if failed {
+			cobra.CheckErr(errors.New("some repositories could not be garbage collected"))
+		}
+	},
+}
+
+func printGC(results []dura.GCResult) {
+	verb, pruned := "collected", "pruned"
+	if gcDryRun {
+		verb, pruned = "would collect", "would prune"
+	}
+	for _, result := range results {
+		fmt.Printf("%s: %s %d refs", result.Repo, verb, len(result.Collected))
+		if gcPruneObjects {
+			fmt.Printf(", %s %d loose objects (%d bytes)", pruned, result.PrunedObjects, result.PrunedBytes)
+		}
+		fmt.Println()
+		for _, collected := range result.Collected {
+			fmt.Printf("  %s (%s, committed as %s)", collected.Ref, shortHash(collected.Tip), shortHash(collected.Commit))
+			if collected.Archive != "" {
+				fmt.Printf(" archived as %s", collected.Archive)
+			}
+			fmt.Println()
+		}
+		for _, ref := range result.Protected {
+			fmt.Printf("  %s kept, it holds a tagged snapshot\n", ref)
+		}
+		if result.Error != "" {
+			fmt.Printf("  error: %s\n", result.Error)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().StringSliceVarP(&gcBranches, "branch", "b", []string{}, "Branches (or any revisions) whose history is searched for the work of the Dura refs. (default: gc.branches)")
+	gcCmd.Flags().BoolVar(&gcArchive, "archive", false, "Move the collected refs to refs/dura-archive/ instead of deleting them. (default: gc.archive)")
+	gcCmd.Flags().BoolVarP(&gcDryRun, "dry-run", "n", false, "Report what would be collected and pruned without changing anything. (default: false)")
+	gcCmd.Flags().BoolVar(&gcPruneObjects, "prune-objects", false, "Remove unreachable loose objects afterwards. (default: false)")
+	gcCmd.Flags().IntVar(&gcPruneExpire, "prune-expire", 0, "Only prune loose objects older than this many days. (default: gc.prune_expire_days)")
+	gcCmd.Flags().BoolVarP(&gcAll, "all", "a", false, "Garbage collect every watched repository. (default: false)")
+	gcCmd.Flags().BoolVar(&gcJSON, "json", false, "Print the results as JSON. (default: false)")
+}
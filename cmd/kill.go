@@ -16,31 +16,41 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	killTimeout time.Duration
+	killForce   bool
+)
+
 // killCmd represents the kill command
 var killCmd = &cobra.Command{
 	Use:   "kill",
 	Short: "Kills the Dura process holding the runtime lock (daemon)",
-	Long:  `Kills the Dura process holding the runtime lock (daemon)`,
+	Long: `Kills the Dura process holding the runtime lock (daemon).
+
+The daemon is sent SIGTERM, upon which it finishes any in-flight capture, releases the runtime lock and clears its PID from the runtime database before exiting. 
+The kill command waits up to the given timeout for the daemon to exit, if it hasn't exited by then and the force flag was provided the daemon is killed (SIGKILL).`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("This command currently does nothing")
+		var pid uint32
+		if pid, err = dura.KillDaemon(killTimeout, killForce); errors.Is(err, dura.ErrNoDaemon) {
+			fmt.Println(err)
+			return
+		}
+		cobra.CheckErr(err)
+		fmt.Printf("Stopped Dura daemon (pid %d)\n", pid)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(killCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// killCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// killCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	killCmd.Flags().DurationVarP(&killTimeout, "timeout", "t", 10*time.Second, "How long to wait for the daemon to exit after asking it to shut down. (default: 10s)")
+	killCmd.Flags().BoolVarP(&killForce, "force", "f", false, "Kill the daemon (SIGKILL) if it has not exited once the timeout has passed. (default: false)")
 }
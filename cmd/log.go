@@ -0,0 +1,135 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+	git "github.com/libgit2/git2go/v33"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	logSince   string
+	logUntil   string
+	logFile    string
+	logBase    string
+	logLineage bool
+	logJSON    bool
+)
+
+// logCmd represents the log command
+var logCmd = &cobra.Command{
+	Use:   "log [path]",
+	Short: "Lists the Dura snapshots of a repository",
+	Long: `Lists the snapshots on every Dura ref of the repository containing path (the current directory by default),
+grouped by the base commit they were taken on top of. For each snapshot the time it was taken, its short hash, the number of
+files changed and the lines inserted and deleted (relative to the previous snapshot) are shown, newest first.
+
+--since and --until only list snapshots taken within the given times, --file only lists snapshots which changed the given
+file or directory and --base only those taken on top of the given base commit.
+
+With commit.lineage enabled, the first snapshot taken after HEAD moves (a commit, rebase or branch switch) continues from the
+previous snapshot. --lineage only lists the snapshots the newest snapshot continues from, giving a continuous history of the
+work in progress across base commits.
+` + timeHelp,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			path   = CWD
+			repo   *git.Repository
+			opts   dura.LogOptions
+			groups []dura.SnapshotGroup
+			now    = time.Now()
+		)
+		if len(args) > 0 {
+			path = args[0]
+		}
+		repo, err = dura.OpenRepository(path)
+		cobra.CheckErr(err)
+		if logSince != "" {
+			opts.Since, err = dura.ParseTime(logSince, now)
+			cobra.CheckErr(err)
+		}
+		if logUntil != "" {
+			opts.Until, err = dura.ParseTime(logUntil, now)
+			cobra.CheckErr(err)
+		}
+		if logFile != "" {
+			opts.File, err = dura.RepoRelPath(repo, logFile)
+			cobra.CheckErr(err)
+		}
+		opts.Base = logBase
+		opts.Lineage = logLineage
+		groups, err = dura.Snapshots(repo, opts)
+		cobra.CheckErr(err)
+		if logJSON {
+			var bytes []byte
+			if groups == nil {
+				groups = []dura.SnapshotGroup{}
+			}
+			bytes, err = json.MarshalIndent(groups, "", "  ")
+			cobra.CheckErr(err)
+			fmt.Println(string(bytes))
+			return
+		}
+		printSnapshots(groups)
+	},
+}
+
+func printSnapshots(groups []dura.SnapshotGroup) {
+	if len(groups) == 0 {
+		fmt.Println("No snapshots found")
+		return
+	}
+	for i, group := range groups {
+		if i > 0 {
+			fmt.Println()
+		}
+		base := "base " + shortHash(group.Base)
+		if group.Base == "" {
+			base = "unborn branch"
+		}
+		fmt.Printf("%s %s (%d snapshots)\n", base, group.BaseSummary, len(group.Snapshots))
+		for _, snapshot := range group.Snapshots {
+			fmt.Printf("  %s  %s  %3d files  +%d -%d",
+				snapshot.Time.Local().Format("2006-01-02 15:04:05"),
+				shortHash(snapshot.Hash),
+				len(snapshot.Files),
+				snapshot.Insertions,
+				snapshot.Deletions,
+			)
+			if snapshot.Previous != "" {
+				fmt.Printf("  (continues %s)", shortHash(snapshot.Previous))
+			}
+			fmt.Println()
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(logCmd)
+
+	logCmd.Flags().StringVar(&logSince, "since", "", "Only list snapshots taken at or after this time.")
+	logCmd.Flags().StringVar(&logUntil, "until", "", "Only list snapshots taken at or before this time.")
+	logCmd.Flags().StringVarP(&logFile, "file", "f", "", "Only list snapshots which changed this file (or anything beneath this directory).")
+	logCmd.Flags().StringVarP(&logBase, "base", "b", "", "Only list snapshots taken on top of this base commit (hash or hash prefix).")
+	logCmd.Flags().BoolVarP(&logLineage, "lineage", "l", false, "Only list the snapshots the newest snapshot continues from, across base commits. (default: false)")
+	logCmd.Flags().BoolVar(&logJSON, "json", false, "Print the snapshots as JSON. (default: false)")
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateNamespace string
+	migrateDryRun    bool
+	migrateAll       bool
+	migrateJSON      bool
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [path]",
+	Short: "Moves existing Dura refs to the configured ref layout",
+	Long: `Moves the Dura refs of the repository containing path (the current directory by default), or of every watched repository
+with --all, to the layout given by commit.ref_pattern within the namespace given by --to-namespace (commit.ref_namespace by
+default), e.g. from the historical refs/heads/dura/<hash> branches to refs/dura/dura/<hash>. Refs keep pointing to the same
+snapshots, so no history is lost.
+
+Refs ending up with the same name, e.g. a legacy ref and the ref the daemon created for the same base commit after the layout
+changed, are merged: the ref whose newest snapshot is the most recent keeps the name and the others are archived under
+refs/dura-archive/, suffixed with their abbreviated commit. Every ref of a repository is moved or none is. Refs already in the
+target layout are left untouched, so migrate can safely be run again. --dry-run prints the moves without making them.
+
+When --to-namespace differs from commit.ref_namespace it is saved to the configuration before the refs are moved, so new
+snapshots are created in the target namespace as well, and the running Dura daemon is told to reload its configuration. The
+namespace it replaces is kept in commit.previous_ref_namespaces: the refs of repositories which fail to migrate are still
+found there, and running migrate again moves them.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			path    = CWD
+			opts    = dura.MigrateOptions{Namespace: migrateNamespace, DryRun: migrateDryRun}
+			results []dura.MigrateResult
+			failed  bool
+		)
+		if len(args) > 0 {
+			path = args[0]
+		}
+		if !migrateDryRun && migrateNamespace != "" && migrateNamespace != dura.GetConfig().Commit.RefNamespace {
+			cobra.CheckErr(dura.GetConfig().SetRefNamespace(migrateNamespace))
+			if !migrateJSON {
+				fmt.Printf("commit.ref_namespace set to %s\n", migrateNamespace)
+			}
+			if _, err = dura.CallDaemon(dura.ControlRequest{Command: dura.ControlReload}); err != nil && !errors.Is(err, dura.ErrNoDaemon) {
+				fmt.Printf("unable to reload the Dura daemon configuration, run dura reload: %s\n", err)
+			}
+		}
+		if migrateAll {
+			if len(args) > 0 {
+				cobra.CheckErr(errors.New("a path can't be given along with --all"))
+			}
+			results = dura.MigrateAll(opts)
+		} else {
+			result := dura.MigrateResult{Repo: path}
+			if result.Moves, err = dura.Migrate(path, opts); err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+		for _, result := range results {
+			failed = failed || result.Error != ""
+		}
+		if migrateJSON {
+			var bytes []byte
+			bytes, err = json.MarshalIndent(results, "", "  ")
+			cobra.CheckErr(err)
+			fmt.Println(string(bytes))
+		} else {
+			printMigration(results)
+		}
+		if failed {
+			cobra.CheckErr(errors.New("some repositories could not be migrated"))
+		}
+	},
+}
+
+func printMigration(results []dura.MigrateResult) {
+	verb := "moved"
+	if migrateDryRun {
+		verb = "would move"
+	}
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			fmt.Printf("%s: %s\n", result.Repo, result.Error)
+		case len(result.Moves) == 0:
+			fmt.Printf("%s: nothing to migrate\n", result.Repo)
+		default:
+			fmt.Printf("%s: %s %d refs\n", result.Repo, verb, len(result.Moves))
+			for _, move := range result.Moves {
+				note := ""
+				if move.Archived {
+					note = ", archived"
+				}
+				fmt.Printf("  %s -> %s (%s%s)\n", move.From, move.To, shortHash(move.Commit), note)
+			}
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVar(&migrateNamespace, "to-namespace", "", "The namespace to move the Dura refs to, such as refs/dura. (default: commit.ref_namespace)")
+	migrateCmd.Flags().BoolVarP(&migrateDryRun, "dry-run", "n", false, "Print the moves without making them. (default: false)")
+	migrateCmd.Flags().BoolVarP(&migrateAll, "all", "a", false, "Migrate every watched repository. (default: false)")
+	migrateCmd.Flags().BoolVar(&migrateJSON, "json", false, "Print the moves as JSON. (default: false)")
+}
@@ -0,0 +1,40 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+
+	"github.com/spf13/cobra"
+)
+
+// pauseCmd represents the pause command
+var pauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "Pauses captures of the running Dura daemon",
+	Long:  `Pauses captures of the running Dura daemon until the resume command is called. The daemon keeps running and holding the runtime lock while paused.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, err = dura.CallDaemon(dura.ControlRequest{Command: dura.ControlPause})
+		cobra.CheckErr(err)
+		fmt.Println("Dura daemon paused")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pauseCmd)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneDryRun bool
+	pruneAll    bool
+	pruneJSON   bool
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune [path]",
+	Short: "Removes old snapshots according to the retention rules",
+	Long: `Applies the retention rules (the [retention] configuration section, along with the overrides of the watched directory) to the
+snapshots of the repository containing path (the current directory by default), or of every watched repository with --all.
+
+Snapshots which are not kept are dropped by rewriting the Dura refs: the kept snapshots are re-created on top of one another, with
+the same content, author, time and message, and refs left without any snapshot are deleted. The commits dropped remain in the
+repository until they are garbage collected. --dry-run prints what would be removed without changing anything.
+
+Snapshots tagged with dura tag, and every snapshot they descend from, are always kept.
+
+The daemon prunes every watched repository on its own every retention.prune_interval_hours hours.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			path    = CWD
+			opts    = dura.PruneOptions{DryRun: pruneDryRun}
+			results []dura.PruneResult
+			failed  bool
+		)
+		if len(args) > 0 {
+			path = args[0]
+		}
+		if pruneAll {
+			if len(args) > 0 {
+				cobra.CheckErr(errors.New("a path can't be given along with --all"))
+			}
+			results = dura.PruneAll(opts)
+		} else {
+			var result *dura.PruneResult
+			if result, err = dura.Prune(path, opts); result == nil {
+				result = &dura.PruneResult{Repo: path}
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			results = append(results, *result)
+		}
+		for _, result := range results {
+			failed = failed || result.Error != ""
+		}
+		if pruneJSON {
+			var bytes []byte
+			bytes, err = json.MarshalIndent(results, "", "  ")
+			cobra.CheckErr(err)
+			fmt.Println(string(bytes))
+		} else {
+			printPrune(results)
+		}
+		if failed {
+			cobra.CheckErr(errors.New("some repositories could not be pruned"))
+		}
+	},
+}
+
+func printPrune(results []dura.PruneResult) {
+	verb := "removed"
+	if pruneDryRun {
+		verb = "would remove"
+	}
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			fmt.Printf("%s: %s\n", result.Repo, result.Error)
+		case result.Disabled:
+			fmt.Printf("%s: no retention rule set, nothing to prune\n", result.Repo)
+		default:
+			fmt.Printf("%s: %s %d of %d snapshots, %d refs rewritten, %d refs deleted\n",
+				result.Repo, verb, result.Removed, result.Snapshots, len(result.Rewritten), len(result.Deleted))
+			if result.Protected > 0 {
+				fmt.Printf("  kept %d snapshots protected by tags\n", result.Protected)
+			}
+			for _, ref := range result.Deleted {
+				fmt.Printf("  deleted %s\n", ref)
+			}
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "n", false, "Print what would be removed without changing anything. (default: false)")
+	pruneCmd.Flags().BoolVarP(&pruneAll, "all", "a", false, "Prune every watched repository. (default: false)")
+	pruneCmd.Flags().BoolVar(&pruneJSON, "json", false, "Print the results as JSON. (default: false)")
+}
@@ -0,0 +1,40 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+
+	"github.com/spf13/cobra"
+)
+
+// reloadCmd represents the reload command
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reloads the configuration of the running Dura daemon",
+	Long:  `Makes the running Dura daemon re-read its configuration file, newly watched repositories are picked up straight away. An invalid configuration is reported and the daemon keeps its current one.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		_, err = dura.CallDaemon(dura.ControlRequest{Command: dura.ControlReload})
+		cobra.CheckErr(err)
+		fmt.Println("Dura daemon configuration reloaded")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reloadCmd)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+	git "github.com/libgit2/git2go/v33"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreAt    string
+	restoreTo    string
+	restoreForce bool
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <path...> --at <time|snapshot>",
+	Short: "Restores files from a Dura snapshot",
+	Long: `Restores the given files, or everything beneath the given directories, to their version in a Dura snapshot.
+
+--at selects the snapshot, a time selects the newest snapshot taken at or before that time across all Dura branches.
+Files are written to the working tree, or with --to extracted beneath another directory (keeping their paths relative
+to the repository root).
+
+Restore refuses to overwrite files whose current content isn't saved anywhere in the repository (neither committed nor
+captured by Dura, files are compared to the staged and newest captured versions after autocrlf and other clean filters), when extracting with --to it refuses to overwrite any file which differs from the snapshot version.
+Nothing is written in either case unless --force is given.
+` + selectorHelp,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			repo     *git.Repository
+			snapshot *git.Commit
+			paths    []string
+			restored []dura.RestoredFile
+		)
+		repo, err = dura.OpenRepository(existingDir(args[0]))
+		cobra.CheckErr(err)
+		snapshot, err = dura.ResolveSnapshot(repo, restoreAt, time.Now())
+		cobra.CheckErr(err)
+		for _, path := range args {
+			var rel string
+			rel, err = dura.RepoRelPath(repo, path)
+			cobra.CheckErr(err)
+			paths = append(paths, rel)
+		}
+		restored, err = dura.Restore(repo, snapshot, paths, dura.RestoreOptions{To: restoreTo, Force: restoreForce})
+		var unsaved *dura.UnsavedChangesError
+		if errors.As(err, &unsaved) {
+			fmt.Println("Refusing to overwrite unsaved changes (use --force to overwrite):")
+			for _, file := range unsaved.Files {
+				fmt.Printf("  %s\n", file)
+			}
+			os.Exit(1)
+		}
+		cobra.CheckErr(err)
+		fmt.Printf("Restored from snapshot %s (%s)\n", shortHash(snapshot.Id().String()), snapshot.Committer().When.Local().Format("2006-01-02 15:04:05"))
+		for _, file := range restored {
+			if file.Unchanged {
+				fmt.Printf("  %s (unchanged)\n", file.Dest)
+			} else {
+				fmt.Printf("  %s\n", file.Dest)
+			}
+		}
+	},
+}
+
+// existingDir returns the closest directory containing path (path itself if it is a
+// directory) which exists, as restored files may no longer be present.
+func existingDir(path string) string {
+	dir, _ := filepath.Abs(path)
+	for {
+		if fileInfo, statErr := os.Stat(dir); statErr == nil && fileInfo.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return CWD
+		}
+		dir = parent
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().StringVarP(&restoreAt, "at", "a", "", "The snapshot to restore from, a commit hash or a time. (required)")
+	restoreCmd.Flags().StringVarP(&restoreTo, "to", "t", "", "Extract the files beneath this directory instead of the working tree.")
+	restoreCmd.Flags().BoolVarP(&restoreForce, "force", "f", false, "Overwrite files even if their current content would be lost. (default: false)")
+	_ = restoreCmd.MarkFlagRequired("at")
+}
@@ -0,0 +1,37 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+const (
+	// timeHelp describes the time expressions accepted wherever a time is expected
+	timeHelp = `
+Times may be given as:
+  now, today, yesterday           optionally followed by a time of day, e.g. "yesterday 14:00"
+  14:00, 2pm                      a time of day today
+  15m ago, 2 hours ago, 1h30m     a time relative to now ("ago" is optional)
+  2022-03-01, "2022-03-01 14:00"  an absolute time, RFC 3339 timestamps, 2022-03 and 2022 are accepted as well
+  @1646140800                     a Unix timestamp`
+
+	// selectorHelp describes the snapshot selectors accepted wherever a snapshot is expected
+	selectorHelp = `
+Snapshots may be selected by:
+  <hash>           a (possibly abbreviated) snapshot commit hash, unless it is also a time (e.g. 100d or 2022)
+  <time>           the newest snapshot across all Dura refs taken at or before time
+  <branch>@{time}  the newest snapshot taken at or before time on the Dura ref named branch (in full or any trailing part
+                   of it, such as dura/<hash>), or on the Dura refs based on the commit another branch or revision points
+                   to, e.g. HEAD@{15m ago} or main@{yesterday}
+` + timeHelp
+)
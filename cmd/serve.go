@@ -33,8 +33,19 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if !cmd.Flags().Changed("log-level") && dura.GetConfig().Dura.LogLevel != "" {
+			logLevel = dura.GetConfig().Dura.LogLevel
+		}
+		if !cmd.Flags().Changed("log-file") {
+			logfile = dura.GetConfig().Dura.LogFile
+		}
 		err = dura.SetGlobalLogLevel(logLevel)
 		cobra.CheckErr(err)
+		if logfile != "" {
+			err = dura.SetLogFile(logfile)
+			cobra.CheckErr(err)
+			defer dura.CloseLogFile()
+		}
 		log.Logger = log.With().Caller().Logger()
 		log.Info().Msgf("Global log level set: %s", strings.ToUpper(logLevel))
 		dura.StartPoller()
@@ -58,7 +69,9 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// serveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-	serveCmd.Flags().StringVarP(&logfile, "log-file", "l", "", `Setting this flag allows for directing Dura logs to the provided logfile destination.`)
+	serveCmd.Flags().StringVarP(&logfile, "log-file", "l", "", `Setting this flag allows for directing Dura logs to the provided logfile destination, overriding dura.log_file.
+The file is rotated according to the dura.log_max_size_mb, dura.log_max_age_days, dura.log_max_backups and dura.log_compress settings
+and reopened when the daemon receives SIGHUP.`)
 	serveCmd.Flags().StringVarP(&logLevel, "log-level", "z", "info", `Sets the log level to one of (from highest to lowest):
 - panic
 - fatal
@@ -69,5 +82,6 @@ func init() {
 - trace
 
 The flag set must mach one of these string values, and if the flag provided does not match the application will exit.
+Overrides dura.log_level when provided.
 `)
 }
@@ -0,0 +1,117 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the state of the Dura daemon and its captures",
+	Long: `Shows the state of the Dura daemon (PID, uptime, mode and configuration file) and, for every
+watched repository, when it was last captured, the last snapshot created (Dura branch, commit and base commit),
+the last error encountered and the average capture latency.
+
+Capture statistics come from the running daemon and start afresh whenever it is restarted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var status *dura.Status
+		status, err = dura.GetStatus()
+		cobra.CheckErr(err)
+		if statusJSON {
+			var bytes []byte
+			bytes, err = json.MarshalIndent(status, "", "  ")
+			cobra.CheckErr(err)
+			fmt.Println(string(bytes))
+			return
+		}
+		printStatus(status)
+	},
+}
+
+func printStatus(status *dura.Status) {
+	if status.Daemon == nil {
+		fmt.Println("Dura daemon: not running")
+	} else {
+		state := "running"
+		if status.Daemon.Paused {
+			state = "paused"
+		}
+		fmt.Printf("Dura daemon: %s (pid %d)\n", state, status.Daemon.Pid)
+		if uptime := status.Daemon.Uptime(); uptime > 0 {
+			fmt.Printf("Uptime:      %s\n", uptime)
+		} else {
+			fmt.Println("Uptime:      unknown (daemon is not answering on its control socket)")
+		}
+		fmt.Printf("Mode:        %s\n", status.Daemon.Mode)
+		fmt.Printf("Config:      %s\n", status.Daemon.ConfigFile)
+	}
+	fmt.Println()
+	if len(status.Repos) == 0 {
+		fmt.Println("No repositories are being watched")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tLAST CAPTURE\tBRANCH\tCOMMIT\tBASE\tAVG LATENCY\tLAST ERROR")
+	for _, repo := range status.Repos {
+		var (
+			lastCapture = "-"
+			branch      = "-"
+			commit      = "-"
+			base        = "-"
+			latency     = "-"
+			lastError   = "-"
+		)
+		if repo.LastCapture != nil {
+			lastCapture = repo.LastCapture.Format(time.RFC3339)
+		}
+		if repo.Capture != nil {
+			branch, commit, base = repo.Capture.DuraBranch, shortHash(repo.Capture.CommitHash), shortHash(repo.Capture.BaseHash)
+		}
+		if repo.Runs > repo.IdleRuns {
+			latency = repo.AverageLatency.Round(time.Microsecond).String()
+		}
+		if repo.LastError != "" {
+			lastError = repo.LastError
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", repo.Path, lastCapture, branch, commit, base, latency, lastError)
+	}
+	w.Flush()
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON instead of a table. (default: false)")
+}
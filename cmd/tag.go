@@ -0,0 +1,124 @@
+/*
+Copyright © 2022 Dane Nelson <apogeesystemsllc@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apogeesystems/go-dura/cmd/dura"
+	git "github.com/libgit2/git2go/v33"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	tagNote   string
+	tagList   bool
+	tagDelete bool
+	tagForce  bool
+	tagPath   string
+	tagJSON   bool
+)
+
+// tagCmd represents the tag command
+var tagCmd = &cobra.Command{
+	Use:   "tag <name> [snapshot]",
+	Short: "Names a Dura snapshot and protects it from pruning",
+	Long: `Names a snapshot (the newest one by default) so it can be found again, e.g. "before-refactor", with an optional note.
+
+Tags are stored under refs/dura-tags/, apart from the tags of the repository. A tagged snapshot, and every snapshot it
+descends from, is never removed by dura prune (nor by the daemon's automatic pruning), and the Dura refs holding it are
+never collected by dura gc. Tagged snapshots may be selected by their hash as usual, see dura tag --list.
+
+--list lists the tags, --delete removes the tag given, lifting the protection. An existing tag is only moved with --force.
+` + selectorHelp,
+	Args: func(cmd *cobra.Command, args []string) error {
+		switch {
+		case tagList:
+			return cobra.NoArgs(cmd, args)
+		case tagDelete:
+			return cobra.ExactArgs(1)(cmd, args)
+		default:
+			return cobra.RangeArgs(1, 2)(cmd, args)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var repo *git.Repository
+		if tagList && tagDelete {
+			cobra.CheckErr(errors.New("--list and --delete can't be given together"))
+		}
+		repo, err = dura.OpenRepository(tagPath)
+		cobra.CheckErr(err)
+		switch {
+		case tagList:
+			var tags []dura.SnapshotTag
+			tags, err = dura.Tags(repo)
+			cobra.CheckErr(err)
+			printTags(tags)
+		case tagDelete:
+			cobra.CheckErr(dura.DeleteTag(repo, args[0]))
+			if !tagJSON {
+				fmt.Printf("deleted tag %s\n", args[0])
+			}
+		default:
+			var (
+				snapshot *git.Commit
+				tag      *dura.SnapshotTag
+				at       = "now"
+			)
+			if len(args) > 1 {
+				at = args[1]
+			}
+			snapshot, err = dura.ResolveSnapshot(repo, at, time.Now())
+			cobra.CheckErr(err)
+			tag, err = dura.CreateTag(repo, args[0], snapshot, tagNote, tagForce)
+			cobra.CheckErr(err)
+			printTags([]dura.SnapshotTag{*tag})
+		}
+	},
+}
+
+func printTags(tags []dura.SnapshotTag) {
+	if tagJSON {
+		if tags == nil {
+			tags = []dura.SnapshotTag{}
+		}
+		bytes, err := json.MarshalIndent(tags, "", "  ")
+		cobra.CheckErr(err)
+		fmt.Println(string(bytes))
+		return
+	}
+	for _, tag := range tags {
+		fmt.Printf("%s  %s  %s", tag.Name, shortHash(tag.Snapshot), tag.Time.Local().Format("2006-01-02 15:04:05"))
+		if tag.Note != "" {
+			fmt.Printf("  %s", tag.Note)
+		}
+		fmt.Println()
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+
+	tagCmd.Flags().StringVarP(&tagNote, "note", "m", "", "A note describing the tagged snapshot.")
+	tagCmd.Flags().BoolVarP(&tagList, "list", "l", false, "List the tags. (default: false)")
+	tagCmd.Flags().BoolVarP(&tagDelete, "delete", "d", false, "Delete the tag given. (default: false)")
+	tagCmd.Flags().BoolVarP(&tagForce, "force", "f", false, "Move the tag if it already exists. (default: false)")
+	tagCmd.Flags().StringVarP(&tagPath, "path", "p", ".", "The repository (or any directory within it) to tag.")
+	tagCmd.Flags().BoolVar(&tagJSON, "json", false, "Print the tags as JSON. (default: false)")
+}
@@ -29,15 +29,34 @@ var (
 	exclude     []string
 	force       bool
 	skip        bool
-	defMaxDepth = 255
+	defMaxDepth = dura.DefMaxDepth
+	// Per-repository commit overrides, only applied when the flags are given
+	watchAuthor          string
+	watchEmail           string
+	watchMessageTemplate string
+	watchBranchPrefix    string
+	// Per-repository retention overrides, only applied when the flags are given
+	watchKeepAllHours int
+	watchKeepHourly   int
+	watchKeepDaily    int
+	watchKeepWeekly   int
+	// Per-repository backup remote and shadow mode, only applied when the flags are given
+	watchBackupRemote string
+	watchShadow       bool
 )
 
 // watchCmd represents the watch command
 var watchCmd = &cobra.Command{
 	Use:   "watch",
 	Short: "Adds git repositories for Dura to watch",
-	Long: `The watch command adds the given paths, which are to be paths to directories representing git repositories, to the Dura configuration. 
+	Long: `The watch command adds the given paths, which are to be paths to directories representing git repositories or directories containing them, to the Dura configuration. 
+A directory that is not a git repository itself is treated as a root, every git repository found beneath it (up to max-depth) is captured and newly created repositories 
+are picked up automatically.
 If more than one path is provided, the include, exclude and max-depth watch configuration settings will be applied to each of the repositories provided.
+The author, email, message-template and branch-prefix flags override the commit settings of the same name for the repositories watched,
+the keep-all-hours, keep-hourly, keep-daily and keep-weekly flags override the retention rules of the same name, backup-remote
+overrides backup.remote (an empty value disables the backup of these repositories) and shadow overrides commit.shadow.
+For a path which is already watched these flags update its overrides, its include, exclude and max-depth settings are left unchanged.
 If the force flag is not provided the CLI will prompt for the user to accept these changes.
 
 This function loops through the paths provided one-by-one calling the appropriate watch command which returns an error each time, the paths will be accessed in the 
@@ -57,12 +76,43 @@ for convenience.`,
 			fmt.Fprintln(os.Stderr, "Max depth must be between 0-255, setting value back to the default (255)")
 			maxDepth = defMaxDepth
 		}
+		wc := dura.WatchConfig{
+			Include:         include,
+			Exclude:         exclude,
+			MaxDepth:        maxDepth,
+			MessageTemplate: watchMessageTemplate,
+			BranchPrefix:    watchBranchPrefix,
+		}
+		if cmd.Flags().Changed("author") {
+			wc.Author = &watchAuthor
+		}
+		if cmd.Flags().Changed("email") {
+			wc.Email = &watchEmail
+		}
+		retention := dura.RetentionOverride{}
+		if cmd.Flags().Changed("keep-all-hours") {
+			retention.KeepAllHours = &watchKeepAllHours
+		}
+		if cmd.Flags().Changed("keep-hourly") {
+			retention.KeepHourly = &watchKeepHourly
+		}
+		if cmd.Flags().Changed("keep-daily") {
+			retention.KeepDaily = &watchKeepDaily
+		}
+		if cmd.Flags().Changed("keep-weekly") {
+			retention.KeepWeekly = &watchKeepWeekly
+		}
+		if retention != (dura.RetentionOverride{}) {
+			wc.Retention = &retention
+		}
+		if cmd.Flags().Changed("backup-remote") {
+			wc.BackupRemote = &watchBackupRemote
+		}
+		if cmd.Flags().Changed("shadow") {
+			wc.Shadow = &watchShadow
+		}
 		for _, path := range args {
-			err = dura.GetConfig().SetWatch(path, dura.WatchConfig{
-				Include:  include,
-				Exclude:  exclude,
-				MaxDepth: maxDepth,
-			})
+			err = dura.GetConfig().SetWatch(path, wc)
 			if !skip {
 				cobra.CheckErr(err)
 			} else if err != nil {
@@ -75,13 +125,23 @@ for convenience.`,
 func init() {
 	rootCmd.AddCommand(watchCmd)
 
-	watchCmd.Flags().IntVarP(&maxDepth, "max-depth", "d", defMaxDepth, "Set recursion max depth, value must be between 0-255. (default: 255)")
+	watchCmd.Flags().IntVarP(&maxDepth, "max-depth", "d", defMaxDepth, "Set recursion max depth, value must be between 0-255, 0 uses the default. (default: 255)")
 	watchCmd.Flags().StringSliceVarP(&include, "include", "i", []string{}, `A comma separated list of gitignore strings representing files/folders to explicitly include in watch routines.
 Example: -i "**/.log,/dura,tests/theTests*.test"
 (default: [])`)
 	watchCmd.Flags().StringSliceVarP(&exclude, "exclude", "e", []string{}, `A comma separated list of gitignore strings representing files/folders to explicitly exclude in watch routines.
 Example: -e "**/.log,/dura,tests/theTests*.test"
 (default: [])`)
+	watchCmd.Flags().StringVar(&watchAuthor, "author", "", "Author name of the Dura commits of these repositories, overriding commit.author.")
+	watchCmd.Flags().StringVar(&watchEmail, "email", "", "Author email of the Dura commits of these repositories, overriding commit.email.")
+	watchCmd.Flags().StringVar(&watchMessageTemplate, "message-template", "", "Commit message template of these repositories, overriding commit.message_template.")
+	watchCmd.Flags().StringVar(&watchBranchPrefix, "branch-prefix", "", "Prefix of the Dura branches of these repositories. (default: dura)")
+	watchCmd.Flags().IntVar(&watchKeepAllHours, "keep-all-hours", 0, "Keep every snapshot of these repositories taken within this many hours, overriding retention.keep_all_hours.")
+	watchCmd.Flags().IntVar(&watchKeepHourly, "keep-hourly", 0, "Number of hourly snapshots of these repositories to keep, overriding retention.keep_hourly.")
+	watchCmd.Flags().IntVar(&watchKeepDaily, "keep-daily", 0, "Number of daily snapshots of these repositories to keep, overriding retention.keep_daily.")
+	watchCmd.Flags().IntVar(&watchKeepWeekly, "keep-weekly", 0, "Number of weekly snapshots of these repositories to keep, overriding retention.keep_weekly.")
+	watchCmd.Flags().StringVar(&watchBackupRemote, "backup-remote", "", "Remote name or repository URL the Dura refs of these repositories are pushed to, overriding backup.remote.")
+	watchCmd.Flags().BoolVar(&watchShadow, "shadow", false, "Keep the snapshots of these repositories in a shadow repository, overriding commit.shadow.")
 	watchCmd.Flags().BoolVarP(&force, "force", "f", false, "Forces the watch action without asking for input (in the case where multiple arguments are provided). (default: false)")
 	watchCmd.Flags().BoolVarP(&skip, "skip", "s", false, "When this flag is present, if an error occurs while processing a repository, the watch command will print the error and continue rather than exiting. (default: false)")
 }
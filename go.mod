@@ -6,6 +6,9 @@ require (
 	github.com/fsnotify/fsnotify v1.5.1
 	github.com/libgit2/git2go/v33 v33.0.4
 	github.com/rs/zerolog v1.26.1
+	github.com/sabhiram/go-gitignore v0.0.0-20210923224102-525f6e181f06
 	github.com/spf13/cobra v1.3.0
 	github.com/spf13/viper v1.10.1
+	golang.org/x/sys v0.0.0-20211210111614-af8b64212486
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )